@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
@@ -15,13 +19,27 @@ import (
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/starnuik/golang_match/pkg/matching"
 	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/notify"
 	"github.com/starnuik/golang_match/pkg/schema"
 )
 
+const (
+	// the radius of the "neighbouring bins" in the user status
+	statusRadius = 1
+	// page sizes of the match history
+	defaultMatchLimit = 50
+	maxMatchLimit     = 500
+)
+
 var (
-	userQueue        model.UserQueue
-	kernel           matching.Kernel
-	matchingTickRate time.Duration
+	queues     map[string]*queue
+	matchStore model.MatchStore
+	// the grid settings changed at runtime
+	settingsStore model.SettingsStore
+	election      model.Election
+	hub           *notify.Hub
+	// queue -> the users taken out by their ttl, served at /debug/vars
+	expiredUsers = expvar.NewMap("expired_users")
 )
 
 func errStatus(ctx *gin.Context, status int, err error) {
@@ -30,6 +48,11 @@ func errStatus(ctx *gin.Context, status int, err error) {
 }
 
 func queueUser(ctx *gin.Context) {
+	q, found := findQueue(ctx)
+	if !found {
+		return
+	}
+
 	var req schema.QueueUserRequest
 
 	err := ctx.BindJSON(&req)
@@ -38,29 +61,279 @@ func queueUser(ctx *gin.Context) {
 		return
 	}
 
-	user, err := userQueue.Parse(&req)
+	user, err := q.users.Parse(&req)
+	if err != nil {
+		errStatus(ctx, http.StatusBadRequest, err)
+		return
+	}
+	err = q.kernelCfg.CheckRoles([]*model.QueuedUser{user})
+	if err != nil {
+		errStatus(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	err = q.users.Add(context.TODO(), user)
+	if err != nil {
+		errStatus(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	q.publishQueued(user.Name)
+}
+
+func queueParty(ctx *gin.Context) {
+	q, found := findQueue(ctx)
+	if !found {
+		return
+	}
+
+	var req schema.QueuePartyRequest
+
+	err := ctx.BindJSON(&req)
+	if err != nil {
+		errStatus(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	members, err := q.users.ParseParty(&req)
+	if err != nil {
+		errStatus(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	// a party has to fit into a single team
+	teamSize := q.kernelCfg.MatchSize / max(1, q.kernelCfg.TeamCount)
+	if len(members) > teamSize {
+		errStatus(ctx, http.StatusBadRequest, fmt.Errorf("party size > %d", teamSize))
+		return
+	}
+	err = q.kernelCfg.CheckRoles(members)
 	if err != nil {
 		errStatus(ctx, http.StatusBadRequest, err)
 		return
 	}
 
-	err = userQueue.Add(context.TODO(), user)
+	err = q.users.AddParty(context.TODO(), members)
+	if err != nil {
+		errStatus(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, user := range members {
+		q.publishQueued(user.Name)
+	}
+}
+
+func dequeueUser(ctx *gin.Context) {
+	q, found := findQueue(ctx)
+	if !found {
+		return
+	}
+	name := ctx.Param("name")
+
+	err := q.users.Delete(context.TODO(), name)
+	if errors.Is(err, model.ErrNotQueued) {
+		errStatus(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errStatus(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	// ends the event streams of the user, on every instance
+	hub.Broadcast(q.key(name), schema.UserEvent{Event: notify.Left})
+}
+
+func heartbeatUser(ctx *gin.Context) {
+	q, found := findQueue(ctx)
+	if !found {
+		return
+	}
+	name := ctx.Param("name")
+
+	err := q.users.Heartbeat(context.TODO(), name)
+	if errors.Is(err, model.ErrNotQueued) {
+		errStatus(ctx, http.StatusNotFound, err)
+		return
+	}
 	if err != nil {
 		errStatus(ctx, http.StatusInternalServerError, err)
 		return
 	}
 }
 
-func matchUsers() {
-	count, err := userQueue.Count(context.TODO())
+func userStatus(ctx *gin.Context) {
+	q, found := findQueue(ctx)
+	if !found {
+		return
+	}
+	name := ctx.Param("name")
+
+	status, err := q.users.Status(context.TODO(), name, statusRadius)
+	if errors.Is(err, model.ErrNotQueued) {
+		errStatus(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errStatus(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	resp := schema.UserStatusResponse{
+		Name:             status.Name,
+		Skill:            status.Skill,
+		Latency:          status.Latency,
+		QueuedAt:         status.QueuedAt,
+		WaitSeconds:      now.Sub(status.QueuedAt).Seconds(),
+		BinS:             status.Bin.S,
+		BinL:             status.Bin.L,
+		Position:         status.Position,
+		BinCount:         status.BinCount,
+		NeighbourCount:   status.NeighbourCount,
+		EstimatedSeconds: -1,
+	}
+
+	estimate, known := q.throughput.Estimate(now, status.Bin, status.Position)
+	if known {
+		resp.EstimatedSeconds = estimate.Seconds()
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func userEvents(ctx *gin.Context) {
+	q, found := findQueue(ctx)
+	if !found {
+		return
+	}
+	name := ctx.Param("name")
+
+	// subscribe before the status check, so that a match can't slip in between
+	events, unsubscribe := hub.Subscribe(q.key(name))
+	defer unsubscribe()
+
+	_, err := q.users.Status(context.TODO(), name, 0)
+	if errors.Is(err, model.ErrNotQueued) {
+		errStatus(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errStatus(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.SSEvent(notify.Queued, schema.UserEvent{Event: notify.Queued})
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-events:
+			ctx.SSEvent(event.Event, event)
+			return !notify.IsFinal(event)
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+func getMatch(ctx *gin.Context) {
+	serial, err := strconv.Atoi(ctx.Param("serial"))
+	if err != nil {
+		errStatus(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	match, err := matchStore.Get(context.TODO(), serial)
+	if errors.Is(err, model.ErrNoMatch) {
+		errStatus(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errStatus(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, match)
+}
+
+func listMatches(ctx *gin.Context) {
+	since, limit, err := parsePage(ctx)
+	if err != nil {
+		errStatus(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	matches, err := matchStore.List(context.TODO(), since, limit)
+	if err != nil {
+		errStatus(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, matchPage(matches, since))
+}
+
+func listUserMatches(ctx *gin.Context) {
+	name := ctx.Param("name")
+
+	since, limit, err := parsePage(ctx)
+	if err != nil {
+		errStatus(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	matches, err := matchStore.ListUser(context.TODO(), name, since, limit)
+	if err != nil {
+		errStatus(ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, matchPage(matches, since))
+}
+
+func parsePage(ctx *gin.Context) (int, int, error) {
+	since, err := strconv.Atoi(ctx.DefaultQuery("since", "0"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultMatchLimit)))
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit < 1 || limit > maxMatchLimit {
+		return 0, 0, fmt.Errorf("limit must be in [1, %d]", maxMatchLimit)
+	}
+
+	return since, limit, nil
+}
+
+func matchPage(matches []schema.MatchResponse, since int) schema.MatchListResponse {
+	next := since
+	if len(matches) > 0 {
+		next = matches[len(matches)-1].Serial
+	}
+	return schema.MatchListResponse{
+		Matches: matches,
+		Next:    next,
+	}
+}
+
+func matchUsers(q *queue) {
+	q.matching.Lock()
+	defer q.matching.Unlock()
+
+	// the abandoned users are taken out before they get matched
+	expireUsers(q)
+
+	count, err := q.users.Count(context.TODO())
 	if err != nil {
 		log.Println(err)
 		return // no db connection anyway
 	}
 
-	log.Printf("%d users queued\n", count)
+	log.Printf("%s: %d users queued\n", q.name, count)
 
-	matches, err := kernel.Match(context.TODO(), userQueue)
+	matches, err := q.kernel.Match(context.TODO(), q.users)
 	if err != nil {
 		log.Println(err)
 		return
@@ -69,22 +342,65 @@ func matchUsers() {
 		return
 	}
 
-	log.Printf("matched %d teams\n", len(matches))
-	finalizeTeams(matches)
+	matches = claimMatches(q, matches)
+	if len(matches) == 0 {
+		return
+	}
+
+	log.Printf("%s: matched %d teams\n", q.name, len(matches))
+	q.throughput.Push(time.Now().UTC(), matches)
+	finalizeTeams(q, matches)
 }
 
-func finalizeTeams(matches []schema.MatchResponse) {
-	matchedUsers := []string{}
-	for _, match := range matches {
-		matchedUsers = append(matchedUsers, match.Names...)
+// expireUsers takes out the users that have not been seen for the ttl of the queue
+func expireUsers(q *queue) {
+	if q.ttl == 0 {
+		return
 	}
 
-	err := userQueue.Remove(context.TODO(), matchedUsers)
+	names, err := q.users.Expire(context.TODO(), time.Now().UTC().Add(-q.ttl))
 	if err != nil {
 		log.Println(err)
+	}
+	if len(names) == 0 {
 		return
 	}
 
+	log.Printf("%s: expired %d users\n", q.name, len(names))
+	expiredUsers.Add(q.name, int64(len(names)))
+	for _, name := range names {
+		hub.Broadcast(q.key(name), schema.UserEvent{Event: notify.Expired})
+	}
+}
+
+// claimMatches takes the users of every match out of the queue, the matches with a user that has left
+// (or has been matched by another instance) meanwhile are discarded, their other users stay queued
+func claimMatches(q *queue, matches []schema.MatchResponse) []schema.MatchResponse {
+	claimed := make([]schema.MatchResponse, 0, len(matches))
+	for _, match := range matches {
+		ok, err := q.users.Claim(context.TODO(), match.Names)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if !ok {
+			log.Printf("%s: discarded a match, a user is gone\n", q.name)
+			continue
+		}
+		claimed = append(claimed, match)
+	}
+	return claimed
+}
+
+func finalizeTeams(q *queue, matches []schema.MatchResponse) {
+	for idx := range matches {
+		matches[idx].Queue = q.name
+		err := matchStore.Add(context.TODO(), &matches[idx])
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
 	for _, resp := range matches {
 		packed, err := json.MarshalIndent(resp, "", " ")
 		if err != nil {
@@ -94,35 +410,136 @@ func finalizeTeams(matches []schema.MatchResponse) {
 
 		fmt.Println(string(packed))
 	}
+
+	for idx := range matches {
+		event := schema.UserEvent{Event: notify.Matched, Match: &matches[idx]}
+		for _, name := range matches[idx].Names {
+			hub.Broadcast(q.key(name), event)
+		}
+	}
 }
 
-func matchUsersLoop() {
+// matchUsersLoop only matches while the instance leads the queue, every instance serves the requests
+func matchUsersLoop(q *queue) {
+	leading := false
 	for {
-		time.Sleep(matchingTickRate)
-		matchUsers()
+		time.Sleep(q.tickRate)
+
+		// the grid may have been reconfigured through another instance, the followers place the users by it too
+		err := q.reload(context.TODO())
+		if err != nil {
+			log.Println(err)
+		}
+
+		lead, err := election.Lead(context.TODO(), q.name)
+		if err != nil {
+			log.Println(err)
+		}
+		if lead != leading {
+			log.Printf("%s: leading(%t)\n", q.name, lead)
+			leading = lead
+		}
+		if !lead {
+			continue
+		}
+
+		matchUsers(q)
 	}
 }
 
-func setupUserQueue(gridSide int) (model.UserQueue, func()) {
-	skillCeil := atoiEnv("TUNING_SKILL_CEIL")
+func setupGrid(s settings, gridSide int) (model.GridConfig, error) {
+	skillCeil, err := s.atoi("TUNING_SKILL_CEIL")
+	if err != nil {
+		return model.GridConfig{}, err
+	}
 	if skillCeil <= 0 {
-		log.Panicln("TUNING_SKILL_CEIL must be > 0")
+		return model.GridConfig{}, errors.New("TUNING_SKILL_CEIL must be > 0")
+	}
+	latencyCeil, err := s.atoi("TUNING_LATENCY_CEIL")
+	if err != nil {
+		return model.GridConfig{}, err
 	}
-	latencyCeil := atoiEnv("TUNING_LATENCY_CEIL")
 	if latencyCeil <= 0 {
-		log.Panicln("TUNING_LATENCY_CEIL must be > 0")
+		return model.GridConfig{}, errors.New("TUNING_LATENCY_CEIL must be > 0")
 	}
 
-	cfg := model.GridConfig{
-		SkillCeil:   float64(skillCeil),
-		LatencyCeil: float64(latencyCeil),
-		Side:        gridSide,
+	partyAggregate := model.PartyAggregate(s.get("TUNING_PARTY_AGGREGATE"))
+	switch partyAggregate {
+	case "":
+		partyAggregate = model.AggregateMean
+	case model.AggregateMean, model.AggregateMax:
+	default:
+		return model.GridConfig{}, errors.New("TUNING_PARTY_AGGREGATE is invalid")
+	}
+
+	axis := func(key string) (model.Axis, error) {
+		name := s.get(key)
+		if name == "" {
+			return model.LinearAxis{}, nil
+		}
+		axis, err := model.ParseAxis(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return axis, nil
+	}
+	skillAxis, err := axis("TUNING_SKILL_AXIS")
+	if err != nil {
+		return model.GridConfig{}, err
+	}
+	latencyAxis, err := axis("TUNING_LATENCY_AXIS")
+	if err != nil {
+		return model.GridConfig{}, err
 	}
 
+	return model.GridConfig{
+		SkillCeil:      float64(skillCeil),
+		LatencyCeil:    float64(latencyCeil),
+		Side:           gridSide,
+		PartyAggregate: partyAggregate,
+		SkillAxis:      skillAxis,
+		LatencyAxis:    latencyAxis,
+	}, nil
+}
+
+// setupStorage returns the constructor of the user queues, they all share the same storage.
+// With postgres the hub is relayed, so the events reach the users subscribed to the other instances
+func setupStorage() (func(model.GridConfig, string) model.UserQueue, model.MatchStore, model.SettingsStore, model.Election, func()) {
 	storageType := os.Getenv("STORAGE_TYPE")
 	switch storageType {
 	case "inmem":
-		return model.NewUserQueueInmemory(cfg), func() {}
+		// optional, the queues are logged into the subdirectories of it and survive the restarts
+		dir := os.Getenv("INMEM_DIR")
+		compactEvery, err := settings{}.atoiOr("INMEM_COMPACT_EVERY", 10_000)
+		if err != nil {
+			log.Panicln(err)
+		}
+		if compactEvery <= 0 {
+			log.Panicln("INMEM_COMPACT_EVERY must be > 0")
+		}
+
+		newQueue := func(cfg model.GridConfig, name string) model.UserQueue {
+			if dir == "" {
+				return model.NewUserQueueInmemory(cfg)
+			}
+			users, err := model.NewUserQueueDurable(cfg, filepath.Join(dir, name), compactEvery)
+			if err != nil {
+				log.Panicln(err)
+			}
+			return users
+		}
+		if dir == "" {
+			return newQueue, model.NewMatchStoreInmemory(), model.NewSettingsStoreInmemory(), model.NewElectionInmemory(), func() {}
+		}
+		matchStore, err := model.NewMatchStoreDurable(dir)
+		if err != nil {
+			log.Panicln(err)
+		}
+		settingsStore, err := model.NewSettingsStoreDurable(dir)
+		if err != nil {
+			log.Panicln(err)
+		}
+		return newQueue, matchStore, settingsStore, model.NewElectionInmemory(), func() {}
 	case "postgres":
 		dbUrl := os.Getenv("DB_URL")
 
@@ -136,76 +553,241 @@ func setupUserQueue(gridSide int) (model.UserQueue, func()) {
 			log.Panicln(err)
 		}
 
-		return model.NewUserQueuePostgres(cfg, db), db.Close
+		newQueue := func(cfg model.GridConfig, name string) model.UserQueue {
+			return model.NewUserQueuePostgres(cfg, db, name)
+		}
+		// the users get the events of the leader from any instance
+		relay := notify.NewRelayPostgres(db, hub)
+		hub.SetRelay(relay)
+		closeDb := func() {
+			relay.Close()
+			db.Close()
+		}
+		return newQueue, model.NewMatchStorePostgres(db), model.NewSettingsStorePostgres(db), model.NewElectionPostgres(db), closeDb
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			log.Panicln("SQLITE_PATH is required")
+		}
+
+		db, err := model.OpenSqlite(path)
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		newQueue := func(cfg model.GridConfig, name string) model.UserQueue {
+			return model.NewUserQueueSqlite(cfg, db, name)
+		}
+		// a single instance, so it always leads
+		return newQueue, model.NewMatchStoreSqlite(db), model.NewSettingsStoreSqlite(db), model.NewElectionInmemory(), func() { db.Close() }
 	default:
 		log.Panicln("STORAGE_TYPE is invalid")
 	}
 	panic("unreachable")
 }
 
-func setupMatching(gridSide int) matching.Kernel {
-	matchSize := atoiEnv("MATCH_SIZE")
+func setupMatching(s settings, gridSide int) (matching.Kernel, matching.KernelConfig, error) {
+	matchSize, err := s.atoi("MATCH_SIZE")
+	if err != nil {
+		return nil, matching.KernelConfig{}, err
+	}
 	if matchSize < 2 {
-		log.Panicln("MATCH_SIZE must be >= 2")
+		return nil, matching.KernelConfig{}, errors.New("MATCH_SIZE must be >= 2")
+	}
+
+	teamCount, err := s.atoiOr("TEAM_COUNT", 1)
+	if err != nil {
+		return nil, matching.KernelConfig{}, err
+	}
+	if teamCount < 1 || matchSize%teamCount != 0 {
+		return nil, matching.KernelConfig{}, errors.New("TEAM_COUNT must be >= 1 and divide MATCH_SIZE")
+	}
+	teamExactLimit, err := s.atoiOr("TUNING_TEAM_EXACT_LIMIT", 16)
+	if err != nil {
+		return nil, matching.KernelConfig{}, err
+	}
+	if teamExactLimit < 0 || teamExactLimit > matching.MaxTeamExactLimit {
+		return nil, matching.KernelConfig{}, fmt.Errorf("TUNING_TEAM_EXACT_LIMIT must be in [0, %d]", matching.MaxTeamExactLimit)
+	}
+
+	roleSlots, err := matching.ParseRoleSlots(s.get("ROLE_SLOTS"))
+	if err != nil {
+		return nil, matching.KernelConfig{}, err
+	}
+	slotCount := 0
+	for _, count := range roleSlots {
+		if count%teamCount != 0 {
+			return nil, matching.KernelConfig{}, errors.New("ROLE_SLOTS counts must be divisible by TEAM_COUNT")
+		}
+		slotCount += count
+	}
+	if len(roleSlots) > 0 && slotCount != matchSize {
+		return nil, matching.KernelConfig{}, errors.New("ROLE_SLOTS counts must sum up to MATCH_SIZE")
+	}
+
+	scorer := matching.DefaultScorer
+	if name := s.get("QUALITY_SCORER"); name != "" {
+		scorer, err = matching.ParseScorer(name)
+		if err != nil {
+			return nil, matching.KernelConfig{}, err
+		}
+	}
+	minQuality, err := s.atofOr("TUNING_QUALITY_MIN", 0)
+	if err != nil {
+		return nil, matching.KernelConfig{}, err
+	}
+	if minQuality < 0 || minQuality > 1 {
+		return nil, matching.KernelConfig{}, errors.New("TUNING_QUALITY_MIN must be in [0, 1]")
+	}
+	qualityRelaxMs, err := s.atoiOr("TUNING_QUALITY_RELAX_MS", 0)
+	if err != nil {
+		return nil, matching.KernelConfig{}, err
+	}
+	if qualityRelaxMs < 0 {
+		return nil, matching.KernelConfig{}, errors.New("TUNING_QUALITY_RELAX_MS must be >= 0")
 	}
 
-	kernelType := os.Getenv("MATCHING_TYPE")
+	kernelType := s.get("MATCHING_TYPE")
 
 	cfg := matching.KernelConfig{
-		MatchSize: matchSize,
-		GridSide:  gridSide,
+		MatchSize:      matchSize,
+		GridSide:       gridSide,
+		TeamCount:      teamCount,
+		TeamExactLimit: teamExactLimit,
+		Scorer:         scorer,
+		MinQuality:     minQuality,
+		QualityRelax:   time.Duration(qualityRelaxMs) * time.Millisecond,
+		RoleSlots:      roleSlots,
 	}
 
 	switch kernelType {
 	case "basic":
-		return matching.NewBasicKernel(cfg)
+		// no tuning
 	case "priority":
-		priorityRadius := atoiEnv("TUNING_PRIORITY_RADIUS")
+		priorityRadius, err := s.atoi("TUNING_PRIORITY_RADIUS")
+		if err != nil {
+			return nil, cfg, err
+		}
 		if priorityRadius < 1 {
-			log.Panicln("TUNING_PRIORITY_RADIUS must be >= 1")
+			return nil, cfg, errors.New("TUNING_PRIORITY_RADIUS must be >= 1")
 		}
 
-		waitLimitMs := atoiEnv("TUNING_WAIT_SOFT_LIMIT_MS")
+		waitLimitMs, err := s.atoi("TUNING_WAIT_SOFT_LIMIT_MS")
+		if err != nil {
+			return nil, cfg, err
+		}
 		waitLimit := time.Duration(waitLimitMs) * time.Millisecond
 
 		cfg.PriorityRadius = priorityRadius
 		cfg.WaitSoftLimit = waitLimit
+	case "adaptive":
+		softLimitMs, err := s.atoi("TUNING_WAIT_SOFT_LIMIT_MS")
+		if err != nil {
+			return nil, cfg, err
+		}
+		hardLimitMs, err := s.atoi("TUNING_WAIT_HARD_LIMIT_MS")
+		if err != nil {
+			return nil, cfg, err
+		}
+		if hardLimitMs <= softLimitMs {
+			return nil, cfg, errors.New("TUNING_WAIT_HARD_LIMIT_MS must be > TUNING_WAIT_SOFT_LIMIT_MS")
+		}
+
+		widen, err := matching.ParseWidenSchedule(s.get("TUNING_WIDEN_SCHEDULE"))
+		if err != nil {
+			return nil, cfg, err
+		}
+
+		maxRadius, err := s.atoiOr("TUNING_WIDEN_MAX_RADIUS", gridSide-1)
+		if err != nil {
+			return nil, cfg, err
+		}
+		if maxRadius < 1 {
+			return nil, cfg, errors.New("TUNING_WIDEN_MAX_RADIUS must be >= 1")
+		}
+
+		cfg.WaitSoftLimit = time.Duration(softLimitMs) * time.Millisecond
+		cfg.WaitHardLimit = time.Duration(hardLimitMs) * time.Millisecond
+		cfg.Widen = widen
+		cfg.MaxRadius = maxRadius
+	case "dbscan":
+		epsilon, err := s.atofOr("TUNING_DBSCAN_EPSILON", 1)
+		if err != nil {
+			return nil, cfg, err
+		}
+		if epsilon <= 0 {
+			return nil, cfg, errors.New("TUNING_DBSCAN_EPSILON must be > 0")
+		}
+
+		cfg.ClusterEpsilon = epsilon
+	case "optimal":
+		objective := matching.DefaultObjective
+		if str := s.get("TUNING_OPTIMAL_OBJECTIVE"); str != "" {
+			objective, err = matching.ParseObjective(str)
+			if err != nil {
+				return nil, cfg, err
+			}
+		}
 
-		return matching.NewBasicKernel(cfg)
+		// a tick must not overrun, there are the queue reads and writes besides the search
+		tickMs, err := s.atoi("TICK_MS")
+		if err != nil {
+			return nil, cfg, err
+		}
+		budgetMs, err := s.atoiOr("TUNING_OPTIMAL_BUDGET_MS", tickMs/2)
+		if err != nil {
+			return nil, cfg, err
+		}
+		if budgetMs <= 0 || budgetMs >= tickMs {
+			return nil, cfg, errors.New("TUNING_OPTIMAL_BUDGET_MS must be in (0, TICK_MS)")
+		}
+
+		cfg.Objective = objective
+		cfg.Budget = time.Duration(budgetMs) * time.Millisecond
 	default:
-		log.Panicln("MATCHING_TYPE is invalid")
+		return nil, cfg, errors.New("MATCHING_TYPE is invalid")
 	}
-	panic("unreachable")
-}
 
-func atoiEnv(key string) int {
-	out, err := strconv.Atoi(os.Getenv(key))
-	if err != nil {
-		log.Panicln(err)
-	}
-	return out
+	kernel, err := matching.NewKernel(kernelType, cfg)
+	return kernel, cfg, err
 }
 
 func main() {
-	tickMs := atoiEnv("TICK_MS")
-	matchingTickRate = time.Duration(tickMs) * time.Millisecond
-	gridSide := atoiEnv("TUNING_GRID_SIDE")
-	if gridSide <= 0 {
-		log.Panicln("TUNING_GRID_SIDE must be > 0")
-	}
-
 	var closeDb func()
-	userQueue, closeDb = setupUserQueue(gridSide)
+	var newQueue func(model.GridConfig, string) model.UserQueue
+	hub = notify.NewHub()
+	newQueue, matchStore, settingsStore, election, closeDb = setupStorage()
 	defer closeDb()
-	kernel = setupMatching(gridSide)
+	defer election.Resign()
+
+	queues = make(map[string]*queue)
+	for name, s := range loadSettings() {
+		queues[name] = setupQueue(name, s, newQueue)
+	}
 
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	r.Use(gin.Recovery())
 
-	r.POST("/api/users", queueUser)
-
-	go matchUsersLoop()
+	// the routes without a queue are served by the default one
+	for _, prefix := range []string{"/api", "/api/queues/:queue"} {
+		r.POST(prefix+"/users", queueUser)
+		r.POST(prefix+"/parties", queueParty)
+		r.DELETE(prefix+"/users/:name", dequeueUser)
+		r.GET(prefix+"/users/:name", userStatus)
+		r.GET(prefix+"/users/:name/events", userEvents)
+		r.POST(prefix+"/users/:name/heartbeat", heartbeatUser)
+		r.PUT(prefix+"/grid", reconfigureGrid)
+	}
+	r.GET("/api/users/:name/matches", listUserMatches)
+	r.GET("/api/matches", listMatches)
+	r.GET("/api/matches/:serial", getMatch)
+	r.GET("/api/ws", userSession)
+	r.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
+	for _, q := range queues {
+		go matchUsersLoop(q)
+	}
 
 	r.Run()
 }
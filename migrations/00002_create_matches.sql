@@ -0,0 +1,25 @@
+create table Matches (
+    Serial bigint generated always as identity primary key,
+    FormedAt timestamp not null,
+    SkillMin double precision not null,
+    SkillAverage double precision not null,
+    SkillMax double precision not null,
+    SkillDeviation double precision not null,
+    LatencyMin double precision not null,
+    LatencyAverage double precision not null,
+    LatencyMax double precision not null,
+    LatencyDeviation double precision not null,
+    WaitMin double precision not null,
+    WaitAverage double precision not null,
+    WaitMax double precision not null,
+    WaitDeviation double precision not null
+);
+
+create table MatchMembers (
+    Serial bigint not null references Matches (Serial) on delete cascade,
+    Position integer not null,
+    Name text not null,
+    primary key (Serial, Position)
+);
+
+create index MatchMembers_Name on MatchMembers (Name);
@@ -0,0 +1,3 @@
+alter table Matches
+    add column Teams jsonb,
+    add column SkillDelta double precision not null default 0;
@@ -0,0 +1,4 @@
+alter table UserQueue
+    add column Party text not null default '';
+
+create index UserQueue_Party on UserQueue (Party) where Party <> '';
@@ -0,0 +1,5 @@
+alter table UserQueue
+    add column Roles text[] not null default '{}';
+
+alter table Matches
+    add column Roles jsonb;
@@ -0,0 +1,10 @@
+alter table UserQueue
+    add column Queue text not null default 'default',
+    drop constraint UserQueue_pkey,
+    add primary key (Queue, Name);
+
+drop index UserQueue_Party;
+create index UserQueue_Party on UserQueue (Queue, Party) where Party <> '';
+
+alter table Matches
+    add column Queue text not null default 'default';
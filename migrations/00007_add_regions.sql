@@ -0,0 +1,5 @@
+alter table UserQueue
+    add column Latencies jsonb;
+
+alter table Matches
+    add column Region text not null default '';
@@ -0,0 +1,2 @@
+alter table Matches
+    add column Quality double precision not null default 0;
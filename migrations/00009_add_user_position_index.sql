@@ -0,0 +1 @@
+create index UserQueue_Pos on UserQueue (Queue, PosS, PosL);
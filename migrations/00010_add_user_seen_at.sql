@@ -0,0 +1,8 @@
+alter table UserQueue
+    add column SeenAt timestamp;
+
+update UserQueue
+    set SeenAt = QueuedAt;
+
+alter table UserQueue
+    alter column SeenAt set not null;
@@ -0,0 +1,4 @@
+create table QueueSettings (
+    Queue text primary key,
+    Settings jsonb not null
+);
@@ -1,8 +1,12 @@
 package matching
 
 import (
+	"cmp"
 	"context"
+	"fmt"
+	"maps"
 	"math"
+	"slices"
 	"time"
 
 	"github.com/starnuik/golang_match/pkg/model"
@@ -14,39 +18,129 @@ type KernelConfig struct {
 	GridSide       int
 	PriorityRadius int
 	WaitSoftLimit  time.Duration
+	// adaptive kernel only
+	WaitHardLimit time.Duration
+	Widen         WidenSchedule
+	MaxRadius     int
+	// the matches are split into teams if > 1, MatchSize must be divisible by it
+	TeamCount int
+	// the most units (parties or single users) that are split into two teams exactly, defaults to and is capped at 16,
+	// the exact split is O(2^n)
+	TeamExactLimit int
+	// dbscan kernel only, the neighbourhood radius in standard deviations, defaults to 1
+	ClusterEpsilon float64
+	// optimal kernel only, the quality of a group and the time limit of a tick (the sweep and the improvements),
+	// default to DefaultObjective and 100ms
+	Objective Objective
+	Budget    time.Duration
+	// rates the groups, defaults to DefaultScorer. The groups below MinQuality are not formed,
+	// the threshold falls to 0 over QualityRelax of wait, no threshold if 0
+	Scorer       Scorer
+	MinQuality   float64
+	QualityRelax time.Duration
+	// role -> slots in a match, the counts must sum up to MatchSize and be divisible by TeamCount.
+	// The matches are only formed if every user can get a slot, no roles if empty
+	RoleSlots map[string]int
 }
 
 type Kernel interface {
 	Match(ctx context.Context, users model.UserQueue) ([]schema.MatchResponse, error)
 }
 
-func binIndices(side int) []model.BinIdx {
-	slice := make([]model.BinIdx, 0, side*side)
-	limit := model.BinIdx{S: side, L: side}
-	for s := 0; s < limit.S; s++ {
-		for l := 0; l < limit.L; l++ {
-			slice = append(slice, model.BinIdx{S: s, L: l})
+// NewKernel builds the kernel by its MATCHING_TYPE name
+func NewKernel(name string, cfg KernelConfig) (Kernel, error) {
+	switch name {
+	case "basic":
+		return NewBasicKernel(cfg), nil
+	case "priority":
+		return NewPriorityKernel(cfg), nil
+	case "adaptive":
+		return NewAdaptiveKernel(cfg), nil
+	case "dbscan":
+		return NewDbscanKernel(cfg), nil
+	case "optimal":
+		return NewOptimalKernel(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown kernel %q", name)
+	}
+}
+
+// an occupied bin and the number of its users
+type binCount struct {
+	Idx   model.BinIdx
+	Count int
+}
+
+// occupiedBins lists the bins of counts that are inside the grid, by the skill, then by the latency.
+// The empty bins are not in counts, so a tick costs as much as there are occupied bins, not side*side
+func occupiedBins(counts map[model.BinIdx]int, side int) []binCount {
+	slice := make([]binCount, 0, len(counts))
+	for idx, count := range counts {
+		if idx.S >= 0 && idx.L >= 0 && idx.S < side && idx.L < side {
+			slice = append(slice, binCount{idx, count})
 		}
 	}
+	slices.SortFunc(slice, func(l binCount, r binCount) int {
+		return cmp.Or(cmp.Compare(l.Idx.S, r.Idx.S), cmp.Compare(l.Idx.L, r.Idx.L))
+	})
 	return slice
 }
 
-func matchBin(bin []*model.QueuedUser, blockSize int) []schema.MatchResponse {
+// enoughUsers reports whether the grid holds a match worth of users, without reading them.
+// The kernels that read the whole grid skip a tick that can't form anything
+func (cfg *KernelConfig) enoughUsers(ctx context.Context, users model.UserQueue) (bool, error) {
+	counts, err := users.Occupied(ctx)
+	if err != nil {
+		return false, err
+	}
+	total := 0
+	for _, occupied := range occupiedBins(counts, cfg.GridSide) {
+		total += occupied.Count
+	}
+	return total >= cfg.MatchSize, nil
+}
+
+// gridCounts counts the users of the bins of a read grid
+func gridCounts(grid map[model.BinIdx][]*model.QueuedUser) map[model.BinIdx]int {
+	counts := make(map[model.BinIdx]int, len(grid))
+	for idx, bin := range grid {
+		if len(bin) > 0 {
+			counts[idx] = len(bin)
+		}
+	}
+	return counts
+}
+
+func (cfg *KernelConfig) matchBin(bin []*model.QueuedUser) []schema.MatchResponse {
 	matches := []schema.MatchResponse{}
 
-	blocks := len(bin) / blockSize
+	for _, match := range cfg.packUnits(groupUnits(bin)) {
+		matches = append(matches, cfg.respond(match))
+	}
+	return matches
+}
+
+// respond is the last stage of every kernel
+func (cfg *KernelConfig) respond(match []*model.QueuedUser) schema.MatchResponse {
+	resp := fillResponse(match)
+	resp.Quality = cfg.scorer().Score(match, resp.FormedAt)
+	slots := cfg.teamSlots()
 
-	for b := range blocks {
-		match := make([]*model.QueuedUser, 0, blockSize)
+	teams := [][]*model.QueuedUser{match}
+	if cfg.TeamCount > 1 {
+		teams = splitTeams(match, cfg.TeamCount, cfg.TeamExactLimit, slots)
+		fillTeams(&resp, teams)
+	}
 
-		for uidx := range blockSize {
-			idx := b*blockSize + uidx
-			match = append(match, bin[idx])
+	if slots != nil {
+		resp.Roles = make(map[string]string, len(match))
+		for _, team := range teams {
+			// the kernels only form the groups that fit
+			roles, _ := assignRoles(team, slots)
+			maps.Copy(resp.Roles, roles)
 		}
-
-		matches = append(matches, fillResponse(match))
 	}
-	return matches
+	return resp
 }
 
 func fillResponse(match []*model.QueuedUser) schema.MatchResponse {
@@ -56,6 +150,7 @@ func fillResponse(match []*model.QueuedUser) schema.MatchResponse {
 	resp.WaitSeconds.Min = math.MaxFloat64
 
 	now := time.Now().UTC()
+	resp.FormedAt = now
 
 	for _, user := range match {
 		waitSeconds := now.Sub(user.QueuedAt).Seconds()
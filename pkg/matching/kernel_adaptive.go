@@ -0,0 +1,208 @@
+package matching
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// WidenSchedule maps the progress between the soft and the hard wait limits [0, 1]
+// to the fraction of the max search radius [0, 1]
+type WidenSchedule func(progress float64) float64
+
+func LinearWiden(progress float64) float64 {
+	return progress
+}
+
+func ExponentialWiden(progress float64) float64 {
+	// 2^(10x) normalized, so that the radius stays small for the first half of the wait
+	return (math.Exp2(10*progress) - 1) / (math.Exp2(10) - 1)
+}
+
+func StepWiden(progress float64) float64 {
+	steps := 4.0
+	return math.Floor(progress*steps) / steps
+}
+
+func ParseWidenSchedule(name string) (WidenSchedule, error) {
+	switch name {
+	case "linear":
+		return LinearWiden, nil
+	case "exponential":
+		return ExponentialWiden, nil
+	case "step":
+		return StepWiden, nil
+	default:
+		return nil, fmt.Errorf("unknown widen schedule %q", name)
+	}
+}
+
+func NewAdaptiveKernel(cfg KernelConfig) Kernel {
+	if cfg.Widen == nil {
+		cfg.Widen = LinearWiden
+	}
+	if cfg.MaxRadius <= 0 {
+		cfg.MaxRadius = cfg.GridSide - 1
+	}
+	return &adaptiveKernel{
+		cfg,
+	}
+}
+
+// adaptiveKernel grows the search radius of every user with their wait time.
+// The users that have waited for the longest are matched first, each with the closest available users.
+type adaptiveKernel struct {
+	KernelConfig
+}
+
+// a radius covering the whole grid
+const unlimitedRadius = -1
+
+func (k *adaptiveKernel) Match(ctx context.Context, users model.UserQueue) ([]schema.MatchResponse, error) {
+	bins := make(map[model.BinIdx][]unit)
+	where := make(map[string]model.BinIdx)
+	queue := []unit{}
+
+	enough, err := k.enoughUsers(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+	if !enough {
+		return []schema.MatchResponse{}, nil
+	}
+	grid, err := users.GetGrid(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, occupied := range occupiedBins(gridCounts(grid), k.GridSide) {
+		idx := occupied.Idx
+		bin := grid[idx]
+
+		units := groupUnits(bin)
+		sortUnitsByWait(units)
+		bins[idx] = units
+		for _, members := range units {
+			where[members[0].Name] = idx
+		}
+		queue = append(queue, units...)
+	}
+	sortUnitsByWait(queue)
+
+	now := time.Now().UTC()
+	taken := make(map[string]struct{})
+	matches := []schema.MatchResponse{}
+
+	for _, anchor := range queue {
+		if _, exists := taken[anchor[0].Name]; exists {
+			continue
+		}
+
+		radius := k.radius(now.Sub(anchor[0].QueuedAt))
+		match := k.gather(bins, where[anchor[0].Name], anchor, radius, taken)
+		if match == nil {
+			continue
+		}
+
+		for _, user := range match {
+			taken[user.Name] = struct{}{}
+		}
+		matches = append(matches, k.respond(match))
+	}
+
+	return matches, nil
+}
+
+// radius returns the search radius in bins for a wait time
+func (k *adaptiveKernel) radius(wait time.Duration) int {
+	if wait < k.WaitSoftLimit {
+		return 0
+	}
+	// also covers a hard limit that is <= the soft one
+	if wait >= k.WaitHardLimit {
+		return unlimitedRadius
+	}
+
+	progress := float64(wait-k.WaitSoftLimit) / float64(k.WaitHardLimit-k.WaitSoftLimit)
+	fraction := min(1, max(0, k.Widen(progress)))
+	return int(math.Floor(fraction * float64(k.MaxRadius)))
+}
+
+// gather walks the rings of bins around the anchor, until the match is filled.
+// Returns nil if there are not enough users in the radius.
+func (k *adaptiveKernel) gather(bins map[model.BinIdx][]unit, center model.BinIdx, anchor unit, radius int, taken map[string]struct{}) []*model.QueuedUser {
+	if radius == unlimitedRadius {
+		radius = k.GridSide
+	}
+
+	candidates := []unit{anchor}
+	for dist := 0; dist <= radius; dist++ {
+		ringUnits := []unit{}
+		for _, idx := range ring(center, dist, k.GridSide) {
+			for _, members := range bins[idx] {
+				name := members[0].Name
+				if _, exists := taken[name]; exists || name == anchor[0].Name {
+					continue
+				}
+				ringUnits = append(ringUnits, members)
+			}
+		}
+
+		// prefer the users that have waited longer, among the equally distant ones
+		sortUnitsByWait(ringUnits)
+		candidates = append(candidates, ringUnits...)
+		if len(ringUnits) == 0 || unitsSize(candidates) < k.MatchSize {
+			continue
+		}
+
+		match := k.fillGroup(candidates)
+		if match != nil {
+			return match
+		}
+	}
+	return nil
+}
+
+// ring returns the bins at exactly dist (chebyshev) from the center, that are inside the grid
+func ring(center model.BinIdx, dist int, side int) []model.BinIdx {
+	if dist == 0 {
+		return []model.BinIdx{center}
+	}
+
+	inside := func(idx model.BinIdx) bool {
+		return idx.S >= 0 && idx.L >= 0 && idx.S < side && idx.L < side
+	}
+
+	slice := []model.BinIdx{}
+	for off := -dist; off <= dist; off++ {
+		edges := []model.BinIdx{
+			{S: center.S + off, L: center.L - dist},
+			{S: center.S + off, L: center.L + dist},
+		}
+		// the corners are already covered by the rows above
+		if off != -dist && off != dist {
+			edges = append(edges,
+				model.BinIdx{S: center.S - dist, L: center.L + off},
+				model.BinIdx{S: center.S + dist, L: center.L + off})
+		}
+
+		for _, idx := range edges {
+			if inside(idx) {
+				slice = append(slice, idx)
+			}
+		}
+	}
+	return slice
+}
+
+// sortUnitsByWait sorts the units by descending wait time, the party members share it
+func sortUnitsByWait(units []unit) {
+	slices.SortStableFunc(units, func(l unit, r unit) int {
+		return l[0].QueuedAt.Compare(r[0].QueuedAt)
+	})
+}
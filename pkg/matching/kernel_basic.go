@@ -32,11 +32,29 @@ func (k *basicKernel) Match(ctx context.Context, users model.UserQueue) ([]schem
 func (k *basicKernel) pass0(ctx context.Context, users model.UserQueue) ([]schema.MatchResponse, error) {
 	matches := []schema.MatchResponse{}
 
-	for _, idx := range binIndices(k.GridSide) {
-		bin, err := users.GetBin(ctx, idx)
-		if err != nil {
-			return nil, err
+	// the counts are cheaper than the users, a tick without a full bin reads nothing else
+	counts, err := users.Occupied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	full := []binCount{}
+	for _, occupied := range occupiedBins(counts, k.GridSide) {
+		if occupied.Count >= k.MatchSize {
+			full = append(full, occupied)
 		}
+	}
+	if len(full) == 0 {
+		return matches, nil
+	}
+
+	grid, err := users.GetGrid(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, occupied := range full {
+		// the users might have left since the counts
+		bin := grid[occupied.Idx]
 
 		blockSize := k.MatchSize
 		if len(bin) < blockSize {
@@ -48,7 +66,7 @@ func (k *basicKernel) pass0(ctx context.Context, users model.UserQueue) ([]schem
 		// 	return l.QueuedAt.Compare(r.QueuedAt)
 		// })
 
-		matches = append(matches, matchBin(bin, blockSize)...)
+		matches = append(matches, k.matchBin(bin)...)
 	}
 
 	return matches, nil
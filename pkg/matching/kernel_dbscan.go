@@ -0,0 +1,218 @@
+package matching
+
+import (
+	"context"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/kelindar/dbscan"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// the neighbourhood radius, in standard deviations
+const defaultClusterEpsilon = 1.0
+
+func NewDbscanKernel(cfg KernelConfig) Kernel {
+	if cfg.ClusterEpsilon <= 0 {
+		cfg.ClusterEpsilon = defaultClusterEpsilon
+	}
+	return &dbscanKernel{
+		cfg,
+	}
+}
+
+// dbscanKernel clusters the whole queue in the (skill, latency, wait) space, each axis normalized by its z-score.
+// Then the groups are carved out of every cluster, around the longest waiting users.
+type dbscanKernel struct {
+	KernelConfig
+}
+
+// a unit as a dbscan point
+type clusterPoint struct {
+	members unit
+	pos     [3]float64
+}
+
+func (p *clusterPoint) Name() string {
+	return p.members[0].Name
+}
+
+func (p *clusterPoint) DistanceTo(other dbscan.Point) float64 {
+	o := other.(*clusterPoint)
+	sum := 0.0
+	for axis := range p.pos {
+		d := p.pos[axis] - o.pos[axis]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+func (k *dbscanKernel) Match(ctx context.Context, users model.UserQueue) ([]schema.MatchResponse, error) {
+	enough, err := k.enoughUsers(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+	if !enough {
+		return []schema.MatchResponse{}, nil
+	}
+	grid, err := users.GetGrid(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	units := []unit{}
+	for _, occupied := range occupiedBins(gridCounts(grid), k.GridSide) {
+		units = append(units, groupUnits(grid[occupied.Idx])...)
+	}
+	// the users might have left since the counts
+	if unitsSize(units) < k.MatchSize {
+		return []schema.MatchResponse{}, nil
+	}
+
+	points := normalizePoints(units, time.Now().UTC())
+	// a party is a single point, so a cluster may have more than enough users
+	clusters := dbscan.Cluster(k.MatchSize, k.ClusterEpsilon, points...)
+	cells := k.indexCells(points)
+
+	// the clusters overlap, a unit is only matched once
+	taken := make(map[string]struct{})
+	matches := []schema.MatchResponse{}
+
+	for _, cluster := range clusters {
+		free := []*clusterPoint{}
+		for _, point := range k.withBorder(cluster, cells) {
+			if _, exists := taken[point.Name()]; !exists {
+				free = append(free, point.(*clusterPoint))
+			}
+		}
+
+		for _, match := range k.carve(free) {
+			// the points are named by the first member, so marking everyone covers them
+			for _, user := range match {
+				taken[user.Name] = struct{}{}
+			}
+			matches = append(matches, k.respond(match))
+		}
+	}
+
+	return matches, nil
+}
+
+// cell is a cube of the normalized space, with a side of ClusterEpsilon.
+// The neighbours of a point are either in its own cell or in the adjacent ones.
+type cell [3]int
+
+func (k *dbscanKernel) cellOf(point *clusterPoint) cell {
+	var c cell
+	for axis := range c {
+		c[axis] = int(math.Floor(point.pos[axis] / k.ClusterEpsilon))
+	}
+	return c
+}
+
+// indexCells buckets the points by their cell
+func (k *dbscanKernel) indexCells(points []dbscan.Point) map[cell][]*clusterPoint {
+	cells := make(map[cell][]*clusterPoint)
+	for _, point := range points {
+		p := point.(*clusterPoint)
+		c := k.cellOf(p)
+		cells[c] = append(cells[c], p)
+	}
+	return cells
+}
+
+// withBorder adds the neighbours of the cluster points back,
+// the lib drops the ones that are not close to some other neighbour
+func (k *dbscanKernel) withBorder(cluster []dbscan.Point, cells map[cell][]*clusterPoint) []dbscan.Point {
+	inside := make(map[string]struct{}, len(cluster))
+	for _, point := range cluster {
+		inside[point.Name()] = struct{}{}
+	}
+
+	out := slices.Clone(cluster)
+	for _, point := range cluster {
+		center := k.cellOf(point.(*clusterPoint))
+		for ds := -1; ds <= 1; ds++ {
+			for dl := -1; dl <= 1; dl++ {
+				for dw := -1; dw <= 1; dw++ {
+					for _, other := range cells[cell{center[0] + ds, center[1] + dl, center[2] + dw}] {
+						if _, exists := inside[other.Name()]; exists {
+							continue
+						}
+						if point.DistanceTo(other) <= k.ClusterEpsilon {
+							inside[other.Name()] = struct{}{}
+							out = append(out, other)
+						}
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// carve groups the longest waiting point of a cluster with its nearest points, until the cluster runs out.
+// The neighbours are looked up by skill, the first axis
+func (k *dbscanKernel) carve(free []*clusterPoint) [][]*model.QueuedUser {
+	units := make([]unit, len(free))
+	skills := make([]float64, len(free))
+	// wait is the last axis
+	waits := make([]float64, len(free))
+	for idx, point := range free {
+		units[idx] = point.members
+		skills[idx] = point.pos[0]
+		waits[idx] = point.pos[2]
+	}
+	distance := func(l int, r int) float64 {
+		return free[l].DistanceTo(free[r])
+	}
+
+	picked, _ := k.sweepWindows(units, skills, waits, distance, k.fillGroup, time.Time{})
+	groups := make([][]*model.QueuedUser, 0, len(picked))
+	for _, group := range picked {
+		groups = append(groups, flatten(group))
+	}
+	return groups
+}
+
+// normalizePoints places the units (by the mean of their members) into the z-score normalized space
+func normalizePoints(units []unit, now time.Time) []dbscan.Point {
+	raw := make([][3]float64, len(units))
+	for idx, members := range units {
+		for _, user := range members {
+			raw[idx][0] += user.Skill / float64(len(members))
+			raw[idx][1] += user.Latency / float64(len(members))
+			raw[idx][2] += now.Sub(user.QueuedAt).Seconds() / float64(len(members))
+		}
+	}
+
+	var mean, sd [3]float64
+	for _, pos := range raw {
+		for axis := range pos {
+			mean[axis] += pos[axis] / float64(len(raw))
+		}
+	}
+	for _, pos := range raw {
+		for axis := range pos {
+			d := pos[axis] - mean[axis]
+			sd[axis] += d * d / float64(len(raw))
+		}
+	}
+	for axis := range sd {
+		// at least a unit (of skill, of latency, a second of wait), otherwise the noise of an axis
+		// without any real spread gets amplified, ie: when everyone has just queued
+		sd[axis] = max(1, math.Sqrt(sd[axis]))
+	}
+
+	points := make([]dbscan.Point, len(units))
+	for idx, members := range units {
+		point := &clusterPoint{members: members}
+		for axis := range point.pos {
+			point.pos[axis] = (raw[idx][axis] - mean[axis]) / sd[axis]
+		}
+		points[idx] = point
+	}
+	return points
+}
@@ -0,0 +1,67 @@
+package matching_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/matching"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernelDbscan(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	gcfg := model.GridConfig{
+		SkillCeil:   10_000,
+		LatencyCeil: 5000,
+		Side:        5,
+	}
+	kcfg := matching.KernelConfig{
+		MatchSize: 4,
+		GridSide:  5,
+	}
+
+	now := time.Now().UTC()
+	users := model.NewUserQueueInmemory(gcfg)
+	add := func(name string, skill float64, latency float64, waited time.Duration) {
+		require.Nil(users.Add(ctx, &model.QueuedUser{
+			Name:     name,
+			Skill:    skill,
+			Latency:  latency,
+			QueuedAt: now.Add(-waited),
+		}))
+	}
+
+	// in standard deviations: the core is ~0.56 away from the edge, the border is ~0.56 away from the edge,
+	// but ~1.13 away from the core, so it's only a neighbour of the edge, the scattered users are 1.5+ away from everyone
+	for idx := range 6 {
+		add(fmt.Sprintf("core%d", idx), 1000, 100, 0)
+	}
+	add("edge", 2500, 100, 0)
+	add("border", 4000, 100, 100*time.Millisecond)
+	add("scattered0", 8000, 100, 0)
+	add("scattered1", 1000, 3000, 0)
+	add("scattered2", 8000, 3000, 0)
+
+	matches, err := matching.NewDbscanKernel(kcfg).Match(ctx, users)
+	require.Nil(err)
+	require.Len(matches, 2)
+
+	matched := []string{}
+	for _, match := range matches {
+		require.Len(match.Names, kcfg.MatchSize)
+		matched = append(matched, match.Names...)
+	}
+	// the scattered users are noise, the border user is matched along with the cluster
+	require.ElementsMatch([]string{"core0", "core1", "core2", "core3", "core4", "core5", "edge", "border"}, matched)
+	// the border user has waited the longest, so it's grouped with its nearest users
+	for _, match := range matches {
+		if slices.Contains(match.Names, "border") {
+			require.Contains(match.Names, "edge")
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKernel(t *testing.T) {
+	require := require.New(t)
+	cfg := KernelConfig{MatchSize: 4, GridSide: 4}
+
+	want := map[string]Kernel{
+		"basic":    &basicKernel{},
+		"priority": &priorityKernel{},
+		"adaptive": &adaptiveKernel{},
+		"dbscan":   &dbscanKernel{},
+		"optimal":  &optimalKernel{},
+	}
+	for name, kernel := range want {
+		got, err := NewKernel(name, cfg)
+		require.Nil(err)
+		require.IsType(kernel, got, name)
+	}
+
+	_, err := NewKernel("unknown", cfg)
+	require.Error(err)
+}
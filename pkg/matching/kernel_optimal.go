@@ -0,0 +1,271 @@
+package matching
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// Objective is the quality of a group: the weighted spreads (standard deviations) of skill and latency are penalized,
+// the mean wait (in seconds) is rewarded. Base is the value of forming a group at all
+type Objective struct {
+	Base    float64
+	Skill   float64
+	Latency float64
+	Wait    float64
+}
+
+var DefaultObjective = Objective{Base: 250, Skill: 1, Latency: 1, Wait: 10}
+
+func (o Objective) quality(group []*model.QueuedUser, now time.Time) float64 {
+	var skill, latency, wait schema.Candle
+	for _, user := range group {
+		subfillCandle(&skill, user.Skill)
+		subfillCandle(&latency, user.Latency)
+		subfillCandle(&wait, now.Sub(user.QueuedAt).Seconds())
+	}
+	finalizeCandle(&skill, len(group))
+	finalizeCandle(&latency, len(group))
+	finalizeCandle(&wait, len(group))
+
+	// the rounding errors may go below 0 for equal values
+	return o.Base - o.Skill*max(0, skill.Deviation) - o.Latency*max(0, latency.Deviation) + o.Wait*wait.Average
+}
+
+// ParseObjective parses "base:value,skill:weight,latency:weight,wait:weight", the missing weights are 0
+func ParseObjective(str string) (Objective, error) {
+	out := Objective{}
+	for _, pair := range strings.Split(str, ",") {
+		axis, weightStr, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found {
+			return out, fmt.Errorf("invalid objective weight %q", pair)
+		}
+		weight, err := strconv.ParseFloat(weightStr, 64)
+		if err != nil || weight < 0 {
+			return out, fmt.Errorf("invalid objective weight %q", pair)
+		}
+
+		switch axis {
+		case "base":
+			out.Base = weight
+		case "skill":
+			out.Skill = weight
+		case "latency":
+			out.Latency = weight
+		case "wait":
+			out.Wait = weight
+		default:
+			return out, fmt.Errorf("unknown objective axis %s", axis)
+		}
+	}
+	return out, nil
+}
+
+const defaultBudget = 100 * time.Millisecond
+
+func NewOptimalKernel(cfg KernelConfig) Kernel {
+	if cfg.Objective == (Objective{}) {
+		cfg.Objective = DefaultObjective
+	}
+	if cfg.Budget <= 0 {
+		cfg.Budget = defaultBudget
+	}
+	return &optimalKernel{
+		cfg,
+	}
+}
+
+// optimalKernel searches for the disjoint groups with the best total quality over the whole queue,
+// a user that is left in the queue adds nothing to it.
+// The groups are built by a sweep over the users sorted by skill, then improved by swapping the units
+// between the groups and with the unmatched units, until the search stops improving.
+// The whole tick is limited by the budget, the sweep included.
+type optimalKernel struct {
+	KernelConfig
+}
+
+// a group and its quality, during the search
+type scoredGroup struct {
+	units   []unit
+	quality float64
+}
+
+func (k *optimalKernel) Match(ctx context.Context, users model.UserQueue) ([]schema.MatchResponse, error) {
+	// the budget is for the whole tick, the reads included
+	deadline := time.Now().Add(k.Budget)
+	if ctxDeadline, exists := ctx.Deadline(); exists && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	enough, err := k.enoughUsers(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+	if !enough {
+		return []schema.MatchResponse{}, nil
+	}
+	grid, err := users.GetGrid(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	units := []unit{}
+	for _, occupied := range occupiedBins(gridCounts(grid), k.GridSide) {
+		units = append(units, groupUnits(grid[occupied.Idx])...)
+	}
+
+	// the sweep stops at the deadline, with the groups it has formed so far (at least one, if there is any),
+	// then the improvements get whatever time is left
+	now := time.Now().UTC()
+	groups, rest := k.sweep(units, now, deadline)
+	k.improve(groups, rest, now, deadline)
+
+	matches := make([]schema.MatchResponse, 0, len(groups))
+	for _, group := range groups {
+		matches = append(matches, k.respond(flatten(group.units)))
+	}
+	return matches, nil
+}
+
+// sweep groups every unit (by descending wait) with the closest free units among its neighbours by skill,
+// until the deadline. The groups of a negative quality are not formed, the users are better off waiting.
+// Returns the groups and the units that are left.
+func (k *optimalKernel) sweep(units []unit, now time.Time, deadline time.Time) ([]scoredGroup, []unit) {
+	skills := make([]float64, len(units))
+	waits := make([]float64, len(units))
+	for idx, members := range units {
+		skills[idx] = meanOf(members, skillOf)
+		waits[idx] = now.Sub(members[0].QueuedAt).Seconds()
+	}
+	distance := func(l int, r int) float64 {
+		return k.distance(units[l], units[r])
+	}
+
+	qualities := []float64{}
+	form := func(candidates []unit) []*model.QueuedUser {
+		// the nearest users are about the best group there is, without the teams and the roles
+		if k.Objective.quality(flatten(candidates)[:k.MatchSize], now) < 0 {
+			return nil
+		}
+		group := k.fillGroup(candidates)
+		if group == nil {
+			return nil
+		}
+		quality := k.Objective.quality(group, now)
+		if quality < 0 {
+			return nil
+		}
+		qualities = append(qualities, quality)
+		return group
+	}
+	picked, taken := k.sweepWindows(units, skills, waits, distance, form, deadline)
+
+	groups := make([]scoredGroup, 0, len(picked))
+	for idx, group := range picked {
+		groups = append(groups, scoredGroup{units: group, quality: qualities[idx]})
+	}
+	rest := []unit{}
+	for idx, members := range units {
+		if !taken[idx] {
+			rest = append(rest, members)
+		}
+	}
+	return groups, rest
+}
+
+// distance between two units, by the weights of the objective
+func (k *optimalKernel) distance(l unit, r unit) float64 {
+	return k.Objective.Skill*math.Abs(meanOf(l, skillOf)-meanOf(r, skillOf)) +
+		k.Objective.Latency*math.Abs(meanOf(l, latencyOf)-meanOf(r, latencyOf))
+}
+
+// improve swaps random units of equal size, keeping the swaps that increase the total quality.
+// A swap between two groups can only improve the spreads, a swap with a free unit also rewards a longer wait.
+func (k *optimalKernel) improve(groups []scoredGroup, rest []unit, now time.Time, deadline time.Time) {
+	if len(groups) == 0 || (len(groups) < 2 && len(rest) == 0) {
+		return
+	}
+
+	// the search has converged if this many swaps in a row have failed
+	patience := 4 * (len(groups) + len(rest))
+	for iter, stale := 0, 0; stale < patience; iter, stale = iter+1, stale+1 {
+		// checking the clock is not free
+		if iter%64 == 0 && time.Now().After(deadline) {
+			return
+		}
+
+		a := &groups[rand.Intn(len(groups))]
+		i := rand.Intn(len(a.units))
+
+		if len(rest) > 0 && (len(groups) < 2 || rand.Intn(2) == 0) {
+			j := rand.Intn(len(rest))
+			if len(a.units[i]) != len(rest[j]) {
+				continue
+			}
+
+			swapped := slices.Clone(a.units)
+			swapped[i] = rest[j]
+			quality, ok := k.score(swapped, now)
+			if !ok || quality <= a.quality {
+				continue
+			}
+			rest[j] = a.units[i]
+			a.units, a.quality = swapped, quality
+			stale = 0
+			continue
+		}
+
+		b := &groups[rand.Intn(len(groups))]
+		if a == b {
+			continue
+		}
+		j := rand.Intn(len(b.units))
+		if len(a.units[i]) != len(b.units[j]) {
+			continue
+		}
+
+		swappedA, swappedB := slices.Clone(a.units), slices.Clone(b.units)
+		swappedA[i], swappedB[j] = b.units[j], a.units[i]
+		qualityA, okA := k.score(swappedA, now)
+		qualityB, okB := k.score(swappedB, now)
+		if !okA || !okB || qualityA+qualityB <= a.quality+b.quality {
+			continue
+		}
+		a.units, a.quality = swappedA, qualityA
+		b.units, b.quality = swappedB, qualityB
+		stale = 0
+	}
+}
+
+// score returns false if the group can't be split into teams with the roles, or it is below the quality threshold
+func (k *optimalKernel) score(group []unit, now time.Time) (float64, bool) {
+	users := flatten(group)
+	if !k.fits(group) || !k.accepts(users, now) {
+		return 0, false
+	}
+	return k.Objective.quality(users, now), true
+}
+
+func skillOf(user *model.QueuedUser) float64 {
+	return user.Skill
+}
+
+func latencyOf(user *model.QueuedUser) float64 {
+	return user.Latency
+}
+
+func meanOf(members unit, axis func(*model.QueuedUser) float64) float64 {
+	sum := 0.0
+	for _, user := range members {
+		sum += axis(user)
+	}
+	return sum / float64(len(members))
+}
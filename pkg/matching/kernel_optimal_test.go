@@ -0,0 +1,138 @@
+package matching_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/matching"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernelOptimalBudget(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	gcfg := model.GridConfig{
+		SkillCeil:   5000,
+		LatencyCeil: 5000,
+		Side:        25,
+	}
+	kcfg := matching.KernelConfig{
+		MatchSize: 8,
+		GridSide:  25,
+		// far less than the sweep takes
+		Budget: time.Nanosecond,
+	}
+
+	dataset := newDataset(overModels("")[0], gcfg, 20_000)
+	// everyone has waited for long enough to be matched
+	dataset.moveQueuedAt(10 * time.Minute)
+
+	// the sweep is cut short too, but it forms a group anyway
+	matches, err := matching.NewOptimalKernel(kcfg).Match(ctx, dataset.model)
+	require.Nil(err)
+	require.NotEmpty(matches)
+
+	names := make(map[string]struct{})
+	for _, match := range matches {
+		require.Len(match.Names, kcfg.MatchSize)
+		for _, name := range match.Names {
+			_, exists := names[name]
+			require.False(exists, name)
+			names[name] = struct{}{}
+		}
+	}
+}
+
+func TestKernelOptimalBudgetLargeQueue(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	gcfg := model.GridConfig{
+		SkillCeil:   5000,
+		LatencyCeil: 5000,
+		Side:        25,
+	}
+	budget := 50 * time.Millisecond
+	kcfg := matching.KernelConfig{
+		MatchSize: 8,
+		GridSide:  25,
+	}
+
+	// a full sweep takes several times the budget
+	size := 20_000
+	dataset := newDataset(overModels("")[0], gcfg, size)
+	dataset.moveQueuedAt(10 * time.Minute)
+
+	// the reads and the sorts before the sweep are not cut short, a kernel without any budget only does those
+	kcfg.Budget = time.Nanosecond
+	start := time.Now()
+	_, err := matching.NewOptimalKernel(kcfg).Match(ctx, dataset.model)
+	require.Nil(err)
+	overhead := time.Since(start)
+
+	kcfg.Budget = budget
+	start = time.Now()
+	matches, err := matching.NewOptimalKernel(kcfg).Match(ctx, dataset.model)
+	elapsed := time.Since(start)
+	require.Nil(err)
+	require.NotEmpty(matches)
+	require.Less(elapsed, overhead+2*budget, "overhead %s", overhead)
+	// the rest of the queue waits for the next tick
+	require.Less(len(matches)*kcfg.MatchSize, size)
+}
+
+func TestKernelOptimalWaits(t *testing.T) {
+	ctx := context.Background()
+	gcfg := model.GridConfig{
+		SkillCeil:   5000,
+		LatencyCeil: 5000,
+		Side:        5,
+	}
+	kcfg := matching.KernelConfig{
+		MatchSize: 4,
+		GridSide:  5,
+		Objective: matching.Objective{Base: 100, Skill: 1, Latency: 1, Wait: 10},
+	}
+	kernel := matching.NewOptimalKernel(kcfg)
+
+	// the skill sd is ~112, so the group is only worth forming after ~1.2 seconds
+	for _, waited := range []time.Duration{0, 5 * time.Second} {
+		t.Run(waited.String(), func(t *testing.T) {
+			require := require.New(t)
+			users := model.NewUserQueueInmemory(gcfg)
+			for _, skill := range []float64{1000, 1100, 1200, 1300} {
+				user := randomUser()
+				user.Skill = skill
+				user.Latency = 100
+				user.QueuedAt = user.QueuedAt.Add(-waited)
+				require.Nil(users.Add(ctx, user))
+			}
+
+			matches, err := kernel.Match(ctx, users)
+			require.Nil(err)
+			if waited == 0 {
+				require.Empty(matches)
+			} else {
+				require.Len(matches, 1)
+			}
+		})
+	}
+}
+
+func TestObjectiveParse(t *testing.T) {
+	require := require.New(t)
+
+	objective, err := matching.ParseObjective("base:250, skill:1,latency:0.5,wait:10")
+	require.Nil(err)
+	require.Equal(matching.Objective{Base: 250, Skill: 1, Latency: 0.5, Wait: 10}, objective)
+
+	objective, err = matching.ParseObjective("skill:2")
+	require.Nil(err)
+	require.Equal(matching.Objective{Skill: 2}, objective)
+
+	for _, invalid := range []string{"", "skill", "skill:x", "skill:-1", "elo:1"} {
+		_, err := matching.ParseObjective(invalid)
+		require.NotNil(err, invalid)
+	}
+}
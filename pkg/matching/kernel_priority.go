@@ -34,7 +34,25 @@ func (k *priorityKernel) Match(ctx context.Context, users model.UserQueue) ([]sc
 
 func (k *priorityKernel) passX(ctx context.Context, users model.UserQueue, kernelSize int, minWait time.Duration) ([]schema.MatchResponse, error) {
 	matches := []schema.MatchResponse{}
-	for _, idx := range binIndices(k.GridSide) {
+	// the kernels don't modify the queue, so the users matched in this pass are skipped instead
+	taken := make(map[string]struct{})
+
+	enough, err := k.enoughUsers(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+	if !enough {
+		return matches, nil
+	}
+	// a single read, the priority users are gathered from it
+	grid, err := users.GetGrid(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+
+	for _, center := range k.centers(grid, kernelSize, minWait, now) {
+		idx := center.Idx
 		lo := model.BinIdx{
 			S: idx.S - kernelSize,
 			L: idx.L - kernelSize,
@@ -44,15 +62,8 @@ func (k *priorityKernel) passX(ctx context.Context, users model.UserQueue, kerne
 			L: idx.L + kernelSize,
 		}
 
-		priorityBin, err := users.GetRect(ctx, lo, hi, minWait)
-		if err != nil {
-			return nil, err
-		}
-
-		bin, err := users.GetBin(ctx, idx)
-		if err != nil {
-			return nil, err
-		}
+		priorityBin := gridRect(grid, lo, hi, minWait, now)
+		bin := grid[idx]
 
 		blockSize := k.MatchSize
 		total := len(priorityBin) + len(bin)
@@ -60,15 +71,19 @@ func (k *priorityKernel) passX(ctx context.Context, users model.UserQueue, kerne
 			continue
 		}
 
-		bin = combineBins(bin, priorityBin)
+		bin = combineBins(bin, priorityBin, taken)
+		if len(bin) < blockSize {
+			continue
+		}
 		slices.SortFunc(bin, func(l *model.QueuedUser, r *model.QueuedUser) int {
 			return l.QueuedAt.Compare(r.QueuedAt)
 		})
 
-		some := matchBin(bin, blockSize)
-		err = cleanMatches(ctx, users, some, k.MatchSize)
-		if err != nil {
-			return nil, err
+		some := k.matchBin(bin)
+		for _, match := range some {
+			for _, name := range match.Names {
+				taken[name] = struct{}{}
+			}
 		}
 
 		matches = append(matches, some...)
@@ -76,31 +91,53 @@ func (k *priorityKernel) passX(ctx context.Context, users model.UserQueue, kerne
 	return matches, nil
 }
 
-func combineBins(left []*model.QueuedUser, right []*model.QueuedUser) []*model.QueuedUser {
-	unique := make(map[string]*model.QueuedUser)
-	for _, user := range left {
-		unique[user.Name] = user
-	}
-	for _, user := range right {
-		unique[user.Name] = user
+// centers are the bins that may form a match: the occupied ones, and the empty ones around the priority users
+// (with a count of 0). The rest of the grid would only have its empty rect read
+func (k *priorityKernel) centers(grid map[model.BinIdx][]*model.QueuedUser, kernelSize int, minWait time.Duration, now time.Time) []binCount {
+	counts := gridCounts(grid)
+	for idx, bin := range grid {
+		if !slices.ContainsFunc(bin, func(user *model.QueuedUser) bool { return now.Sub(user.QueuedAt) >= minWait }) {
+			continue
+		}
+		for s := idx.S - kernelSize; s <= idx.S+kernelSize; s++ {
+			for l := idx.L - kernelSize; l <= idx.L+kernelSize; l++ {
+				around := model.BinIdx{S: s, L: l}
+				if _, exists := counts[around]; !exists {
+					counts[around] = 0
+				}
+			}
+		}
 	}
+	return occupiedBins(counts, k.GridSide)
+}
 
-	slice := make([]*model.QueuedUser, 0, len(unique))
-	for _, user := range unique {
-		slice = append(slice, user)
+// gridRect is GetRect over the read grid
+func gridRect(grid map[model.BinIdx][]*model.QueuedUser, lo model.BinIdx, hi model.BinIdx, minWait time.Duration, now time.Time) []*model.QueuedUser {
+	slice := []*model.QueuedUser{}
+	for s := lo.S; s <= hi.S; s++ {
+		for l := lo.L; l <= hi.L; l++ {
+			for _, user := range grid[model.BinIdx{S: s, L: l}] {
+				if now.Sub(user.QueuedAt) >= minWait {
+					slice = append(slice, user)
+				}
+			}
+		}
 	}
 	return slice
 }
 
-func cleanMatches(ctx context.Context, users model.UserQueue, matches []schema.MatchResponse, matchSize int) error {
-	matchedUsers := make([]string, 0, len(matches)*matchSize)
-	for _, match := range matches {
-		matchedUsers = append(matchedUsers, match.Names...)
+// combineBins merges the bins, without the taken users
+func combineBins(left []*model.QueuedUser, right []*model.QueuedUser, taken map[string]struct{}) []*model.QueuedUser {
+	unique := make(map[string]*model.QueuedUser)
+	for _, user := range slices.Concat(left, right) {
+		if _, exists := taken[user.Name]; !exists {
+			unique[user.Name] = user
+		}
 	}
 
-	err := users.Remove(ctx, matchedUsers)
-	if err != nil {
-		return err
+	slice := make([]*model.QueuedUser, 0, len(unique))
+	for _, user := range unique {
+		slice = append(slice, user)
 	}
-	return nil
+	return slice
 }
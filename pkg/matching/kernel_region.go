@@ -0,0 +1,66 @@
+package matching
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// NewRegionKernel only forms the matches within a single region, if the queue has regions
+func NewRegionKernel(inner Kernel) Kernel {
+	return &regionKernel{
+		inner: inner,
+	}
+}
+
+// regionKernel runs the inner kernel in the grid of every region.
+// A user may be in the candidate matches of several regions, the ones with the lowest max latency are kept.
+type regionKernel struct {
+	inner Kernel
+}
+
+func (k *regionKernel) Match(ctx context.Context, users model.UserQueue) ([]schema.MatchResponse, error) {
+	regional, ok := users.(model.RegionalQueue)
+	if !ok {
+		return k.inner.Match(ctx, users)
+	}
+
+	candidates := []schema.MatchResponse{}
+	for _, region := range regional.Regions() {
+		some, err := k.inner.Match(ctx, regional.Region(region))
+		if err != nil {
+			return nil, err
+		}
+
+		for idx := range some {
+			some[idx].Region = region
+		}
+		candidates = append(candidates, some...)
+	}
+
+	slices.SortStableFunc(candidates, func(l schema.MatchResponse, r schema.MatchResponse) int {
+		return cmp.Compare(l.Latency.Max, r.Latency.Max)
+	})
+
+	taken := make(map[string]struct{})
+	isTaken := func(name string) bool {
+		_, exists := taken[name]
+		return exists
+	}
+
+	matches := []schema.MatchResponse{}
+	for _, match := range candidates {
+		if slices.ContainsFunc(match.Names, isTaken) {
+			continue
+		}
+
+		for _, name := range match.Names {
+			taken[name] = struct{}{}
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
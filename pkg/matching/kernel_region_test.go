@@ -0,0 +1,104 @@
+package matching_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/matching"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernelRegions(t *testing.T) {
+	ctx := context.Background()
+	gcfg := model.GridConfig{
+		SkillCeil:   5000,
+		LatencyCeil: 5000,
+		Side:        5,
+	}
+	kcfg := matching.KernelConfig{
+		MatchSize:      4,
+		GridSide:       5,
+		WaitSoftLimit:  15 * time.Second,
+		WaitHardLimit:  60 * time.Second,
+		PriorityRadius: 2,
+	}
+	regionNames := []string{"eu", "us", "asia"}
+
+	for _, kFactory := range overKernels() {
+		t.Run(kFactory.label, func(t *testing.T) {
+			require := require.New(t)
+			users := model.NewUserQueueRegional(gcfg, model.NewUserQueueInmemory(gcfg), regionNames, func(grid model.GridConfig, _ string) model.UserQueue {
+				return model.NewUserQueueInmemory(grid)
+			})
+
+			dict := make(map[string]*model.QueuedUser)
+			for range 200 {
+				user := randomUser()
+				user.Latencies = make(map[string]float64)
+				// every user has a latency to one or more regions
+				for idx, region := range regionNames {
+					if idx == 0 || rand.Intn(2) == 0 {
+						user.Latencies[region] = user.Latency + float64(idx)*rand.Float64()*300
+					}
+				}
+				dict[user.Name] = user
+				require.Nil(users.Add(ctx, user))
+			}
+
+			kernel := matching.NewRegionKernel(kFactory.build(kcfg))
+			matches, err := kernel.Match(ctx, users)
+			require.Nil(err)
+			require.NotEmpty(matches)
+
+			names := make(map[string]struct{})
+			for _, match := range matches {
+				require.Len(match.Names, kcfg.MatchSize)
+				require.Contains(regionNames, match.Region)
+
+				highest := 0.0
+				for _, name := range match.Names {
+					require.NotContains(names, name)
+					names[name] = struct{}{}
+
+					latency, exists := dict[name].Latencies[match.Region]
+					require.True(exists)
+					highest = max(highest, latency)
+				}
+				require.InDelta(highest, match.Latency.Max, 1e-9)
+			}
+		})
+	}
+}
+
+func TestKernelRegionsLowestLatency(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	gcfg := model.GridConfig{SkillCeil: 10_000, LatencyCeil: 10_000, Side: 1}
+	users := model.NewUserQueueRegional(gcfg, model.NewUserQueueInmemory(gcfg), []string{"eu", "us"}, func(grid model.GridConfig, _ string) model.UserQueue {
+		return model.NewUserQueueInmemory(grid)
+	})
+
+	for idx, latencies := range []map[string]float64{
+		{"eu": 10, "us": 100},
+		{"eu": 120, "us": 90},
+	} {
+		users.Add(ctx, &model.QueuedUser{
+			Name:      fmt.Sprintf("user%d", idx),
+			Skill:     1000,
+			Latency:   10,
+			QueuedAt:  time.Now().UTC(),
+			Latencies: latencies,
+		})
+	}
+
+	kernel := matching.NewRegionKernel(matching.NewBasicKernel(matching.KernelConfig{MatchSize: 2, GridSide: 1}))
+	matches, err := kernel.Match(ctx, users)
+	require.Nil(err)
+	require.Len(matches, 1)
+	require.Equal("us", matches[0].Region)
+	require.Equal(100.0, matches[0].Latency.Max)
+}
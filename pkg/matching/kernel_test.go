@@ -28,6 +28,7 @@ func TestKernelBasic(t *testing.T) {
 		MatchSize:      matchSize,
 		GridSide:       gridSide,
 		WaitSoftLimit:  15 * time.Second,
+		WaitHardLimit:  60 * time.Second,
 		PriorityRadius: 2,
 	}
 
@@ -72,6 +73,39 @@ func TestKernelBasic(t *testing.T) {
 
 }
 
+func TestKernelFewUsers(t *testing.T) {
+	ctx := context.Background()
+	gcfg := model.GridConfig{
+		SkillCeil:   5000,
+		LatencyCeil: 5000,
+		Side:        25,
+	}
+	kcfg := matching.KernelConfig{
+		MatchSize:      8,
+		GridSide:       25,
+		WaitSoftLimit:  15 * time.Second,
+		WaitHardLimit:  60 * time.Second,
+		PriorityRadius: 2,
+	}
+
+	for _, kFactory := range overKernels() {
+		t.Run(kFactory.label, func(t *testing.T) {
+			require := require.New(t)
+
+			dataset := newDataset(overModels("")[0], gcfg, kcfg.MatchSize-1)
+			// everyone may be matched with anyone, if only there were enough of them
+			dataset.moveQueuedAt(10 * time.Minute)
+			counted := &countingQueue{UserQueue: dataset.model}
+
+			matches, err := kFactory.build(kcfg).Match(ctx, counted)
+			require.Nil(err)
+			require.Empty(matches)
+			// only the counts are read
+			require.Equal(1, counted.reads)
+		})
+	}
+}
+
 func TestKernelSimulated(t *testing.T) {
 	gridSide := 25
 	gcfg := model.GridConfig{
@@ -88,6 +122,7 @@ func TestKernelSimulated(t *testing.T) {
 					MatchSize:      matchSize,
 					GridSide:       gridSide,
 					WaitSoftLimit:  15 * time.Second,
+					WaitHardLimit:  60 * time.Second,
 					PriorityRadius: 2,
 				}
 				kernel := kFactory.build(kcfg)
@@ -169,3 +204,125 @@ func runSimulation(dataset *dataset, kernel matching.Kernel, matchSize int, user
 
 	return stats
 }
+
+func TestKernelAdaptiveWiden(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	gcfg := model.GridConfig{
+		SkillCeil:   10,
+		LatencyCeil: 10,
+		Side:        10,
+	}
+	kcfg := matching.KernelConfig{
+		MatchSize:     2,
+		GridSide:      10,
+		WaitSoftLimit: 10 * time.Second,
+		WaitHardLimit: 20 * time.Second,
+		Widen:         matching.LinearWiden,
+		MaxRadius:     4,
+	}
+	kernel := matching.NewAdaptiveKernel(kcfg)
+	now := time.Now().UTC()
+
+	// bin (0, 0) and bin (2, 2)
+	users := model.NewUserQueueInmemory(gcfg)
+	users.Add(ctx, &model.QueuedUser{Name: "a", Skill: 0.5, Latency: 0.5, QueuedAt: now})
+	users.Add(ctx, &model.QueuedUser{Name: "b", Skill: 2.5, Latency: 2.5, QueuedAt: now})
+
+	matches, err := kernel.Match(ctx, users)
+	require.Nil(err)
+	require.Len(matches, 0)
+
+	// halfway to the hard limit the radius is 2
+	users.Remove(ctx, []string{"a"})
+	users.Add(ctx, &model.QueuedUser{Name: "a", Skill: 0.5, Latency: 0.5, QueuedAt: now.Add(-15 * time.Second)})
+	matches, err = kernel.Match(ctx, users)
+	require.Nil(err)
+	require.Len(matches, 1)
+	require.ElementsMatch([]string{"a", "b"}, matches[0].Names)
+
+	// past the hard limit the distance doesn't matter
+	users.Remove(ctx, []string{"b"})
+	users.Add(ctx, &model.QueuedUser{Name: "b", Skill: 9.5, Latency: 9.5, QueuedAt: now})
+	matches, err = kernel.Match(ctx, users)
+	require.Nil(err)
+	require.Len(matches, 0)
+
+	users.Remove(ctx, []string{"a"})
+	users.Add(ctx, &model.QueuedUser{Name: "a", Skill: 0.5, Latency: 0.5, QueuedAt: now.Add(-21 * time.Second)})
+	matches, err = kernel.Match(ctx, users)
+	require.Nil(err)
+	require.Len(matches, 1)
+}
+
+func TestKernelParties(t *testing.T) {
+	ctx := context.Background()
+	gcfg := model.GridConfig{
+		SkillCeil:   5000,
+		LatencyCeil: 5000,
+		Side:        5,
+	}
+	kcfg := matching.KernelConfig{
+		MatchSize:      8,
+		GridSide:       5,
+		WaitSoftLimit:  15 * time.Second,
+		WaitHardLimit:  60 * time.Second,
+		PriorityRadius: 2,
+		TeamCount:      2,
+		// the optimal kernel would rather wait than group the fresh random parties
+		Objective: matching.Objective{Base: 10_000, Skill: 1, Latency: 1},
+	}
+
+	for _, kFactory := range overKernels() {
+		t.Run(kFactory.label, func(t *testing.T) {
+			require := require.New(t)
+			users := model.NewUserQueueInmemory(gcfg)
+			partyOf := make(map[string]string)
+			partySize := make(map[string]int)
+
+			// parties of 1 to 4 users
+			for idx := range 40 {
+				name := fmt.Sprintf("party%d", idx)
+				members := []*model.QueuedUser{}
+				for range 1 + idx%4 {
+					user := randomUser()
+					user.Party = name
+					partyOf[user.Name] = name
+					members = append(members, user)
+				}
+				partySize[name] = len(members)
+				require.Nil(users.AddParty(ctx, members))
+			}
+
+			matches, err := kFactory.build(kcfg).Match(ctx, users)
+			require.Nil(err)
+			require.NotEmpty(matches)
+
+			for _, match := range matches {
+				require.Len(match.Names, kcfg.MatchSize)
+
+				// the parties are never split, neither between the matches nor between the teams
+				inMatch := make(map[string]int)
+				for _, name := range match.Names {
+					inMatch[partyOf[name]]++
+				}
+				for party, count := range inMatch {
+					require.Equal(partySize[party], count)
+				}
+
+				require.Len(match.Teams, kcfg.TeamCount)
+				for _, team := range match.Teams {
+					require.Len(team.Names, kcfg.MatchSize/kcfg.TeamCount)
+
+					inTeam := make(map[string]int)
+					for _, name := range team.Names {
+						inTeam[partyOf[name]]++
+					}
+					for party, count := range inTeam {
+						require.Equal(partySize[party], count)
+					}
+				}
+			}
+		})
+	}
+}
@@ -34,6 +34,24 @@ func overKernels() []factoryKernel {
 			},
 			label: "priority",
 		},
+		{
+			build: func(cfg matching.KernelConfig) matching.Kernel {
+				return matching.NewAdaptiveKernel(cfg)
+			},
+			label: "adaptive",
+		},
+		{
+			build: func(cfg matching.KernelConfig) matching.Kernel {
+				return matching.NewDbscanKernel(cfg)
+			},
+			label: "dbscan",
+		},
+		{
+			build: func(cfg matching.KernelConfig) matching.Kernel {
+				return matching.NewOptimalKernel(cfg)
+			},
+			label: "optimal",
+		},
 	}
 }
 
@@ -55,10 +73,17 @@ func overModels(dbUrl string) []factoryModel {
 				db, _ := pgxpool.New(context.Background(), dbUrl)
 				db.Exec(context.Background(), `delete from UserQueue`)
 				// can't `defer db.Close()`
-				return model.NewUserQueuePostgres(cfg, db)
+				return model.NewUserQueuePostgres(cfg, db, model.DefaultQueue)
 			},
 			label: "postgres",
 		},
+		{
+			build: func(cfg model.GridConfig) model.UserQueue {
+				db, _ := model.OpenSqlite(":memory:")
+				return model.NewUserQueueSqlite(cfg, db, model.DefaultQueue)
+			},
+			label: "sqlite",
+		},
 	}
 }
 
@@ -0,0 +1,147 @@
+package matching
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/starnuik/golang_match/pkg/model"
+)
+
+// teamSlots expands the role slots of a single team, sorted by the role.
+// Returns nil if the matches have no roles.
+func (cfg *KernelConfig) teamSlots() []string {
+	teamCount := max(cfg.TeamCount, 1)
+
+	roles := make([]string, 0, len(cfg.RoleSlots))
+	for role := range cfg.RoleSlots {
+		roles = append(roles, role)
+	}
+	slices.Sort(roles)
+
+	slots := []string{}
+	for _, role := range roles {
+		for range cfg.RoleSlots[role] / teamCount {
+			slots = append(slots, role)
+		}
+	}
+	if len(slots) == 0 {
+		return nil
+	}
+	return slots
+}
+
+// rolesFit reports whether every user of a (partial) team can get a slot
+func rolesFit(team []unit, slots []string) bool {
+	if slots == nil {
+		return true
+	}
+	_, ok := assignRoles(flatten(team), slots)
+	return ok
+}
+
+// assignRoles gives every user a slot of one of their roles (or of any role, if they have none),
+// with kuhn's augmenting paths over the bipartite graph of users and slots.
+// The users are offered their roles by preference. Returns false if there is no such assignment.
+func assignRoles(users []*model.QueuedUser, slots []string) (map[string]string, bool) {
+	if len(users) > len(slots) {
+		return nil, false
+	}
+
+	// the slots every user can take, by preference
+	edges := make([][]int, len(users))
+	for u, user := range users {
+		if len(user.Roles) == 0 {
+			for s := range slots {
+				edges[u] = append(edges[u], s)
+			}
+			continue
+		}
+		for _, role := range user.Roles {
+			for s, slot := range slots {
+				if slot == role {
+					edges[u] = append(edges[u], s)
+				}
+			}
+		}
+	}
+
+	owner := make([]int, len(slots))
+	for s := range owner {
+		owner[s] = -1
+	}
+
+	var augment func(u int, visited []bool) bool
+	augment = func(u int, visited []bool) bool {
+		for _, s := range edges[u] {
+			if visited[s] {
+				continue
+			}
+			visited[s] = true
+			if owner[s] < 0 || augment(owner[s], visited) {
+				owner[s] = u
+				return true
+			}
+		}
+		return false
+	}
+
+	for u := range users {
+		if !augment(u, make([]bool, len(slots))) {
+			return nil, false
+		}
+	}
+
+	roles := make(map[string]string, len(users))
+	for s, u := range owner {
+		if u >= 0 {
+			roles[users[u].Name] = slots[s]
+		}
+	}
+	return roles, true
+}
+
+// ParseRoleSlots parses "role:count,role:count", an empty string means no roles
+func ParseRoleSlots(str string) (map[string]int, error) {
+	slots := make(map[string]int)
+	if len(str) == 0 {
+		return slots, nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		role, countStr, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || len(role) == 0 {
+			return nil, fmt.Errorf("invalid role slot %q", pair)
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid role count %q", pair)
+		}
+		if _, exists := slots[role]; exists {
+			return nil, fmt.Errorf("duplicate role %s", role)
+		}
+		slots[role] = count
+	}
+	return slots, nil
+}
+
+// CheckRoles returns an error if the users (a single one or a party) could never get their slots in a match
+func (cfg *KernelConfig) CheckRoles(users []*model.QueuedUser) error {
+	slots := cfg.teamSlots()
+	if slots == nil {
+		return nil
+	}
+
+	for _, user := range users {
+		for _, role := range user.Roles {
+			if _, exists := cfg.RoleSlots[role]; !exists {
+				return fmt.Errorf("unknown role %s", role)
+			}
+		}
+	}
+	if !rolesFit([]unit{users}, slots) {
+		return fmt.Errorf("not enough role slots for the party")
+	}
+	return nil
+}
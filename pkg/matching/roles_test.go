@@ -0,0 +1,142 @@
+package matching_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/matching"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRolesAssigned(t *testing.T) {
+	ctx := context.Background()
+	gcfg := model.GridConfig{SkillCeil: 10_000, LatencyCeil: 10_000, Side: 1}
+	slots := map[string]int{"tank": 2, "healer": 2, "damage": 4}
+	// plenty of damage, few tanks and healers, some flexible users
+	prefs := [][]string{
+		{"damage"}, {"damage"}, {"damage", "tank"}, {"tank"}, {"healer", "damage"},
+		{"damage"}, {"damage"}, {}, {"damage", "healer"}, {"damage"},
+	}
+
+	for _, teamCount := range []int{1, 2} {
+		for _, kFactory := range overKernels() {
+			label := fmt.Sprintf("%s_teamCount(%d)", kFactory.label, teamCount)
+			t.Run(label, func(t *testing.T) {
+				require := require.New(t)
+				users := model.NewUserQueueInmemory(gcfg)
+				byName := make(map[string]*model.QueuedUser)
+				for idx := range 40 {
+					user := randomUser()
+					user.Roles = prefs[idx%len(prefs)]
+					byName[user.Name] = user
+					require.Nil(users.Add(ctx, user))
+				}
+
+				kernel := kFactory.build(matching.KernelConfig{
+					MatchSize:      8,
+					GridSide:       1,
+					PriorityRadius: 1,
+					WaitSoftLimit:  15 * time.Second,
+					WaitHardLimit:  60 * time.Second,
+					TeamCount:      teamCount,
+					RoleSlots:      slots,
+					// the optimal kernel would rather wait than group the fresh random users
+					Objective: matching.Objective{Base: 10_000, Skill: 1, Latency: 1},
+				})
+				matches, err := kernel.Match(ctx, users)
+				require.Nil(err)
+				require.NotEmpty(matches)
+
+				for _, match := range matches {
+					require.Len(match.Roles, len(match.Names))
+
+					teams := [][]string{match.Names}
+					if teamCount > 1 {
+						teams = nil
+						for _, team := range match.Teams {
+							teams = append(teams, team.Names)
+						}
+					}
+
+					for _, team := range teams {
+						counts := make(map[string]int)
+						for _, name := range team {
+							role := match.Roles[name]
+							counts[role]++
+
+							user := byName[name]
+							if len(user.Roles) > 0 {
+								require.Contains(user.Roles, role)
+							}
+						}
+						for role, count := range slots {
+							require.Equal(count/teamCount, counts[role])
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRolesUnassignable(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	users := model.NewUserQueueInmemory(model.GridConfig{SkillCeil: 10_000, LatencyCeil: 10_000, Side: 1})
+	for idx := range 8 {
+		users.Add(ctx, &model.QueuedUser{
+			Name:     fmt.Sprintf("user%d", idx),
+			Skill:    1000,
+			Latency:  100,
+			QueuedAt: time.Now().UTC(),
+			Roles:    []string{"damage"},
+		})
+	}
+
+	kcfg := matching.KernelConfig{
+		MatchSize: 4,
+		GridSide:  1,
+		RoleSlots: map[string]int{"tank": 1, "healer": 1, "damage": 2},
+	}
+	matches, err := matching.NewBasicKernel(kcfg).Match(ctx, users)
+	require.Nil(err)
+	require.Empty(matches)
+
+	// a flexible user and a healer complete a match
+	users.Add(ctx, &model.QueuedUser{Name: "flex", Skill: 1000, Latency: 100, QueuedAt: time.Now().UTC()})
+	users.Add(ctx, &model.QueuedUser{Name: "healer", Skill: 1000, Latency: 100, QueuedAt: time.Now().UTC(), Roles: []string{"healer"}})
+	matches, err = matching.NewBasicKernel(kcfg).Match(ctx, users)
+	require.Nil(err)
+	require.Len(matches, 1)
+	require.Equal("tank", matches[0].Roles["flex"])
+	require.Equal("healer", matches[0].Roles["healer"])
+
+	party := []*model.QueuedUser{
+		{Name: "tank0", Roles: []string{"tank"}},
+		{Name: "tank1", Roles: []string{"tank"}},
+	}
+	require.Error(kcfg.CheckRoles(party))
+	require.Error(kcfg.CheckRoles([]*model.QueuedUser{{Name: "mage", Roles: []string{"mage"}}}))
+	require.Nil(kcfg.CheckRoles(party[:1]))
+}
+
+func TestRolesParse(t *testing.T) {
+	require := require.New(t)
+
+	slots, err := matching.ParseRoleSlots("tank:2, healer:2,damage:4")
+	require.Nil(err)
+	require.Equal(map[string]int{"tank": 2, "healer": 2, "damage": 4}, slots)
+
+	slots, err = matching.ParseRoleSlots("")
+	require.Nil(err)
+	require.Empty(slots)
+
+	for _, invalid := range []string{"tank", "tank:0", ":2", "tank:x", "tank:1,tank:2"} {
+		_, err = matching.ParseRoleSlots(invalid)
+		require.Error(err, invalid)
+	}
+}
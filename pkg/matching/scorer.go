@@ -0,0 +1,102 @@
+package matching
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/model"
+)
+
+// Scorer rates a candidate group in [0, 1], higher is better
+type Scorer interface {
+	Score(group []*model.QueuedUser, now time.Time) float64
+}
+
+// SpreadScorer is 1 / (1 + Skill * skill sd + Latency * latency sd), ie: 0.5 at the spread of 1 / weight
+type SpreadScorer struct {
+	Skill   float64
+	Latency float64
+}
+
+func (s SpreadScorer) Score(group []*model.QueuedUser, _ time.Time) float64 {
+	var skill, latency float64
+	for _, user := range group {
+		skill += user.Skill
+		latency += user.Latency
+	}
+	skill /= float64(len(group))
+	latency /= float64(len(group))
+
+	var skillSd, latencySd float64
+	for _, user := range group {
+		skillSd += (user.Skill - skill) * (user.Skill - skill)
+		latencySd += (user.Latency - latency) * (user.Latency - latency)
+	}
+	skillSd = math.Sqrt(skillSd / float64(len(group)))
+	latencySd = math.Sqrt(latencySd / float64(len(group)))
+
+	return 1 / (1 + s.Skill*skillSd + s.Latency*latencySd)
+}
+
+// EloScorer is how even the duels between every pair of users in the group are, by their elo win probability.
+// A pair with equal skill scores 1, a pair where one always wins scores 0
+type EloScorer struct {
+	// the skill difference at which the stronger user wins 10 times out of 11, 400 for the chess elo
+	Scale float64
+}
+
+func (s EloScorer) Score(group []*model.QueuedUser, _ time.Time) float64 {
+	if len(group) < 2 {
+		return 1
+	}
+
+	sum := 0.0
+	pairs := 0
+	for i := range group {
+		for j := i + 1; j < len(group); j++ {
+			win := 1 / (1 + math.Pow(10, (group[j].Skill-group[i].Skill)/s.Scale))
+			sum += 1 - 2*math.Abs(win-0.5)
+			pairs++
+		}
+	}
+	return sum / float64(pairs)
+}
+
+var DefaultScorer Scorer = SpreadScorer{Skill: 0.01, Latency: 0.01}
+
+func ParseScorer(name string) (Scorer, error) {
+	switch name {
+	case "spread":
+		return DefaultScorer, nil
+	case "elo":
+		return EloScorer{Scale: 400}, nil
+	default:
+		return nil, fmt.Errorf("unknown scorer %q", name)
+	}
+}
+
+func (cfg *KernelConfig) scorer() Scorer {
+	if cfg.Scorer == nil {
+		return DefaultScorer
+	}
+	return cfg.Scorer
+}
+
+// accepts reports whether the group's quality clears the threshold.
+// The threshold falls linearly to 0 over QualityRelax, by the longest wait in the group
+func (cfg *KernelConfig) accepts(group []*model.QueuedUser, now time.Time) bool {
+	if cfg.MinQuality <= 0 {
+		return true
+	}
+
+	threshold := cfg.MinQuality
+	if cfg.QualityRelax > 0 {
+		longest := time.Duration(0)
+		for _, user := range group {
+			longest = max(longest, now.Sub(user.QueuedAt))
+		}
+		threshold *= max(0, 1-float64(longest)/float64(cfg.QualityRelax))
+	}
+	return cfg.scorer().Score(group, now) >= threshold
+}
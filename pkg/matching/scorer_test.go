@@ -0,0 +1,95 @@
+package matching_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/matching"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScorers(t *testing.T) {
+	require := require.New(t)
+	now := time.Now().UTC()
+	group := func(skills ...float64) []*model.QueuedUser {
+		users := []*model.QueuedUser{}
+		for _, skill := range skills {
+			users = append(users, &model.QueuedUser{Skill: skill, Latency: 100})
+		}
+		return users
+	}
+
+	spread := matching.SpreadScorer{Skill: 0.01, Latency: 0.01}
+	require.InDelta(1, spread.Score(group(1000, 1000), now), 1e-9)
+	// skill sd of 100
+	require.InDelta(0.5, spread.Score(group(900, 1100), now), 1e-9)
+	require.Greater(spread.Score(group(900, 1100), now), spread.Score(group(800, 1200), now))
+
+	elo := matching.EloScorer{Scale: 400}
+	require.InDelta(1, elo.Score(group(1000, 1000, 1000), now), 1e-9)
+	// the stronger one wins 10 times out of 11
+	require.InDelta(1-2*(10.0/11-0.5), elo.Score(group(1000, 1400), now), 1e-9)
+	require.InDelta(elo.Score(group(1000, 1400), now), elo.Score(group(1400, 1000), now), 1e-9)
+
+	for _, name := range []string{"spread", "elo"} {
+		_, err := matching.ParseScorer(name)
+		require.Nil(err)
+	}
+	_, err := matching.ParseScorer("glicko")
+	require.NotNil(err)
+}
+
+func TestKernelQualityThreshold(t *testing.T) {
+	ctx := context.Background()
+	gcfg := model.GridConfig{
+		SkillCeil:   5000,
+		LatencyCeil: 5000,
+		Side:        5,
+	}
+	kcfg := matching.KernelConfig{
+		MatchSize:      4,
+		GridSide:       5,
+		WaitSoftLimit:  15 * time.Second,
+		WaitHardLimit:  60 * time.Second,
+		PriorityRadius: 2,
+		MinQuality:     0.5,
+		QualityRelax:   30 * time.Second,
+		// the optimal kernel would rather wait than group the fresh random users
+		Objective: matching.Objective{Base: 10_000, Skill: 1, Latency: 1},
+	}
+	scorer := matching.DefaultScorer
+
+	for _, kFactory := range overKernels() {
+		t.Run(kFactory.label, func(t *testing.T) {
+			require := require.New(t)
+			kernel := kFactory.build(kcfg)
+			dataset := newDataset(overModels("")[0], gcfg, 200)
+
+			matches, err := kernel.Match(ctx, dataset.model)
+			require.Nil(err)
+			for _, match := range matches {
+				users := []*model.QueuedUser{}
+				for _, name := range match.Names {
+					users = append(users, dataset.dict[name])
+				}
+				// the threshold has already relaxed a little, by the time the users have waited
+				relaxed := 1 - match.WaitSeconds.Max/kcfg.QualityRelax.Seconds()
+				require.GreaterOrEqual(match.Quality, kcfg.MinQuality*relaxed)
+				require.InDelta(scorer.Score(users, match.FormedAt), match.Quality, 1e-9)
+			}
+			dataset.remove(matches)
+
+			// the threshold is gone after the relax time
+			dataset.moveQueuedAt(kcfg.QualityRelax)
+			matches, err = kernel.Match(ctx, dataset.model)
+			require.Nil(err)
+			require.NotEmpty(matches)
+			for _, match := range matches {
+				require.GreaterOrEqual(match.Quality, 0.0)
+				require.LessOrEqual(match.Quality, 1.0)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package matching
+
+import (
+	"cmp"
+	"math"
+	"slices"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// two teams of up to this many units in total are split exactly, the enumeration is O(2^n)
+const (
+	defaultTeamExactLimit = 16
+	MaxTeamExactLimit     = 16
+)
+
+// splitTeams partitions the match into equally sized teams, minimizing the difference in total skill.
+// Two small teams are found exactly by enumeration, others by a greedy draft and a local search.
+// The parties always end up in a single team, and every team can fill its role slots (if not nil).
+func splitTeams(match []*model.QueuedUser, teamCount int, exactLimit int, slots []string) [][]*model.QueuedUser {
+	if exactLimit <= 0 {
+		exactLimit = defaultTeamExactLimit
+	}
+
+	units := groupUnits(match)
+	teamSize := len(match) / teamCount
+
+	var teams [][]unit
+	ok := false
+	if teamCount == 2 && len(units) <= min(exactLimit, MaxTeamExactLimit) {
+		teams, ok = splitTwoExact(units, teamSize, slots)
+	}
+	if !ok {
+		teams = splitHeuristic(units, teamCount, teamSize, slots)
+	}
+
+	flat := make([][]*model.QueuedUser, 0, len(teams))
+	for _, team := range teams {
+		flat = append(flat, flatten(team))
+	}
+	return flat
+}
+
+// splitTwoExact is not ok if no split has equally sized teams that fill their slots
+func splitTwoExact(units []unit, teamSize int, slots []string) ([][]unit, bool) {
+	size := len(units)
+	sums := make([]float64, size)
+	total := 0.0
+	for idx, u := range units {
+		sums[idx] = skillSum(u)
+		total += sums[idx]
+	}
+
+	bestMask := -1
+	bestDelta := math.MaxFloat64
+	// the first unit is always in the first team, the mirrored splits are the same
+	for mask := 1; mask < 1<<size; mask += 2 {
+		users := 0
+		sum := 0.0
+		for idx, u := range units {
+			if mask&(1<<idx) != 0 {
+				users += len(u)
+				sum += sums[idx]
+			}
+		}
+		if users != teamSize {
+			continue
+		}
+
+		delta := math.Abs(total - 2*sum)
+		if delta >= bestDelta {
+			continue
+		}
+		if slots != nil {
+			teams := maskTeams(units, mask)
+			if !rolesFit(teams[0], slots) || !rolesFit(teams[1], slots) {
+				continue
+			}
+		}
+		bestDelta = delta
+		bestMask = mask
+	}
+
+	if bestMask < 0 {
+		return nil, false
+	}
+	return maskTeams(units, bestMask), true
+}
+
+func maskTeams(units []unit, mask int) [][]unit {
+	teams := [][]unit{{}, {}}
+	for idx, u := range units {
+		if mask&(1<<idx) != 0 {
+			teams[0] = append(teams[0], u)
+		} else {
+			teams[1] = append(teams[1], u)
+		}
+	}
+	return teams
+}
+
+func splitHeuristic(units []unit, teamCount int, teamSize int, slots []string) [][]unit {
+	sorted := slices.Clone(units)
+	slices.SortFunc(sorted, func(l unit, r unit) int {
+		// descending, the large parties are the hardest to place
+		if len(l) != len(r) {
+			return cmp.Compare(len(r), len(l))
+		}
+		return cmp.Compare(skillSum(r), skillSum(l))
+	})
+
+	teams := make([][]unit, teamCount)
+	sums := make([]float64, teamCount)
+	room := make([]int, teamCount)
+	for t := range room {
+		room[t] = teamSize
+	}
+	if !draftUnits(sorted, teams, sums, room, slots) && !draftUnits(sorted, teams, sums, room, nil) {
+		// the parties can't fill the teams exactly, but nobody is left out
+		overfillUnits(sorted, teams, sums, room)
+	}
+
+	// swap equally sized units between the strongest and the weakest teams, while it helps
+	for {
+		hi, lo := extremeTeams(sums)
+		gap := sums[hi] - sums[lo]
+
+		bestI, bestJ := -1, -1
+		bestGap := gap
+		for i, strong := range teams[hi] {
+			for j, weak := range teams[lo] {
+				if len(strong) != len(weak) {
+					continue
+				}
+				diff := skillSum(strong) - skillSum(weak)
+				newGap := math.Abs(gap - 2*diff)
+				if diff <= 0 || newGap >= bestGap {
+					continue
+				}
+				if slots != nil && !swapFits(teams[hi], i, teams[lo], j, slots) {
+					continue
+				}
+				bestI, bestJ, bestGap = i, j, newGap
+			}
+		}
+		if bestI < 0 {
+			break
+		}
+
+		diff := skillSum(teams[hi][bestI]) - skillSum(teams[lo][bestJ])
+		teams[hi][bestI], teams[lo][bestJ] = teams[lo][bestJ], teams[hi][bestI]
+		sums[hi] -= diff
+		sums[lo] += diff
+	}
+
+	return teams
+}
+
+// swapFits reports whether both of the teams can still fill their slots, after swapping strong[i] and weak[j]
+func swapFits(strong []unit, i int, weak []unit, j int, slots []string) bool {
+	newStrong := slices.Clone(strong)
+	newWeak := slices.Clone(weak)
+	newStrong[i], newWeak[j] = weak[j], strong[i]
+	return rolesFit(newStrong, slots) && rolesFit(newWeak, slots)
+}
+
+// draftUnits gives every unit to the weakest team that has room (and a role) for it,
+// backtracking if the parties don't fit
+func draftUnits(units []unit, teams [][]unit, sums []float64, room []int, slots []string) bool {
+	if len(units) == 0 {
+		return true
+	}
+	u := units[0]
+	sum := skillSum(u)
+
+	order := make([]int, len(teams))
+	for t := range order {
+		order[t] = t
+	}
+	slices.SortStableFunc(order, func(l int, r int) int {
+		return cmp.Compare(sums[l], sums[r])
+	})
+
+	for _, t := range order {
+		if room[t] < len(u) {
+			continue
+		}
+
+		teams[t] = append(teams[t], u)
+		if rolesFit(teams[t], slots) {
+			sums[t] += sum
+			room[t] -= len(u)
+			if draftUnits(units[1:], teams, sums, room, slots) {
+				return true
+			}
+			sums[t] -= sum
+			room[t] += len(u)
+		}
+		teams[t] = teams[t][:len(teams[t])-1]
+	}
+	return false
+}
+
+// overfillUnits gives every unit to the team with the most room left, even if it doesn't fit
+func overfillUnits(units []unit, teams [][]unit, sums []float64, room []int) {
+	for _, u := range units {
+		best := 0
+		for t := range teams {
+			if room[t] > room[best] || (room[t] == room[best] && sums[t] < sums[best]) {
+				best = t
+			}
+		}
+		teams[best] = append(teams[best], u)
+		sums[best] += skillSum(u)
+		room[best] -= len(u)
+	}
+}
+
+// fillTeams adds the teams, with their candles and the skill delta, to the response
+func fillTeams(resp *schema.MatchResponse, teams [][]*model.QueuedUser) {
+	lo, hi := math.MaxFloat64, -math.MaxFloat64
+
+	for _, members := range teams {
+		team := schema.Team{}
+		team.Skill.Min = math.MaxFloat64
+		team.Latency.Min = math.MaxFloat64
+
+		for _, user := range members {
+			team.Names = append(team.Names, user.Name)
+			subfillCandle(&team.Skill, user.Skill)
+			subfillCandle(&team.Latency, user.Latency)
+		}
+
+		finalizeCandle(&team.Skill, len(members))
+		finalizeCandle(&team.Latency, len(members))
+
+		lo = min(lo, team.Skill.Average)
+		hi = max(hi, team.Skill.Average)
+		resp.Teams = append(resp.Teams, team)
+	}
+
+	resp.SkillDelta = hi - lo
+}
+
+func extremeTeams(sums []float64) (int, int) {
+	hi, lo := 0, 0
+	for t, sum := range sums {
+		if sum > sums[hi] {
+			hi = t
+		}
+		if sum < sums[lo] {
+			lo = t
+		}
+	}
+	return hi, lo
+}
+
+func skillSum(team []*model.QueuedUser) float64 {
+	sum := 0.0
+	for _, user := range team {
+		sum += user.Skill
+	}
+	return sum
+}
@@ -0,0 +1,43 @@
+package matching
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTeamsExactNoFit(t *testing.T) {
+	require := require.New(t)
+
+	// two parties of 3 and a party of 2 can't make two teams of 4
+	match := []*model.QueuedUser{}
+	for idx, party := range []string{"a", "a", "a", "b", "b", "b", "c", "c"} {
+		match = append(match, &model.QueuedUser{
+			Name:  fmt.Sprintf("user%d", idx),
+			Skill: float64(1000 + idx*100),
+			Party: party,
+		})
+	}
+
+	units := groupUnits(match)
+	_, ok := splitTwoExact(units, 4, nil)
+	require.False(ok)
+
+	teams := splitTeams(match, 2, 16, nil)
+	require.Len(teams, 2)
+	require.NotEmpty(teams[0])
+	require.NotEmpty(teams[1])
+	require.ElementsMatch(match, append(teams[0], teams[1]...))
+	// the parties are still never split
+	teamOf := map[string]int{}
+	for t, team := range teams {
+		for _, user := range team {
+			if prev, seen := teamOf[user.Party]; seen {
+				require.Equal(prev, t, "party %s is split", user.Party)
+			}
+			teamOf[user.Party] = t
+		}
+	}
+}
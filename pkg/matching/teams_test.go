@@ -0,0 +1,77 @@
+package matching_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/matching"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTeamsExact(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	users := model.NewUserQueueInmemory(model.GridConfig{SkillCeil: 10_000, LatencyCeil: 10_000, Side: 1})
+	for idx, skill := range []float64{1000, 1100, 1200, 1300, 1400, 1500, 1600, 2500} {
+		users.Add(ctx, &model.QueuedUser{
+			Name:     fmt.Sprintf("user%d", idx),
+			Skill:    skill,
+			Latency:  100,
+			QueuedAt: time.Now().UTC(),
+		})
+	}
+
+	kernel := matching.NewBasicKernel(matching.KernelConfig{
+		MatchSize: 8,
+		GridSide:  1,
+		TeamCount: 2,
+	})
+	matches, err := kernel.Match(ctx, users)
+	require.Nil(err)
+	require.Len(matches, 1)
+
+	match := matches[0]
+	require.Len(match.Teams, 2)
+	require.Len(match.Teams[0].Names, 4)
+	require.Len(match.Teams[1].Names, 4)
+	// 2500+1000+1100+1200 vs 1300+1400+1500+1600
+	require.InDelta(0, match.SkillDelta, 1e-9)
+	require.ElementsMatch(match.Names, append(match.Teams[0].Names, match.Teams[1].Names...))
+}
+
+func TestTeamsHeuristic(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	users := model.NewUserQueueInmemory(model.GridConfig{SkillCeil: 10_000, LatencyCeil: 10_000, Side: 1})
+	for idx := range 60 {
+		users.Add(ctx, &model.QueuedUser{
+			Name:     fmt.Sprintf("user%d", idx),
+			Skill:    rand.NormFloat64()*800.0 + 2500.0,
+			Latency:  100,
+			QueuedAt: time.Now().UTC(),
+		})
+	}
+
+	kernel := matching.NewBasicKernel(matching.KernelConfig{
+		MatchSize: 60,
+		GridSide:  1,
+		TeamCount: 3,
+	})
+	matches, err := kernel.Match(ctx, users)
+	require.Nil(err)
+	require.Len(matches, 1)
+
+	match := matches[0]
+	require.Len(match.Teams, 3)
+	for _, team := range match.Teams {
+		require.Len(team.Names, 20)
+	}
+	// the average skill is off by less than one sd of a user's skill divided by the team size
+	require.Less(match.SkillDelta, 40.0)
+}
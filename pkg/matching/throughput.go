@@ -0,0 +1,98 @@
+package matching
+
+import (
+	"sync"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// Throughput keeps the matches formed during a sliding window,
+// to estimate how fast the users of a bin are being matched
+type Throughput struct {
+	mu     sync.Mutex
+	grid   model.GridConfig
+	window time.Duration
+	events []throughputEvent
+}
+
+type throughputEvent struct {
+	at    time.Time
+	idx   model.BinIdx
+	users int
+}
+
+func NewThroughput(grid model.GridConfig, window time.Duration) *Throughput {
+	return &Throughput{
+		grid:   grid,
+		window: window,
+	}
+}
+
+// Push records the matches, a match is attributed to the bin of its average skill and latency
+func (t *Throughput) Push(now time.Time, matches []schema.MatchResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, match := range matches {
+		center := model.QueuedUser{
+			Skill:   match.Skill.Average,
+			Latency: match.Latency.Average,
+		}
+		t.events = append(t.events, throughputEvent{
+			at:    now,
+			idx:   t.grid.ToIndex(&center),
+			users: len(match.Names),
+		})
+	}
+
+	t.prune(now)
+}
+
+// Rate returns the amount of users matched per second in a bin
+func (t *Throughput) Rate(now time.Time, idx model.BinIdx) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now)
+
+	users := 0
+	for _, event := range t.events {
+		if event.idx == idx {
+			users += event.users
+		}
+	}
+	return float64(users) / t.window.Seconds()
+}
+
+// Estimate returns the expected time until a user with the given position in a bin is matched,
+// false if there were no matches in the bin recently
+func (t *Throughput) Estimate(now time.Time, idx model.BinIdx, position int) (time.Duration, bool) {
+	rate := t.Rate(now, idx)
+	if rate <= 0 {
+		return 0, false
+	}
+
+	seconds := float64(position+1) / rate
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// Reconfigure forgets the matches, their bins are of the old grid
+func (t *Throughput) Reconfigure(grid model.GridConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.grid = grid
+	t.events = nil
+}
+
+func (t *Throughput) prune(now time.Time) {
+	after := now.Add(-t.window)
+
+	first := 0
+	for first < len(t.events) && t.events[first].at.Before(after) {
+		first++
+	}
+	t.events = t.events[first:]
+}
@@ -0,0 +1,52 @@
+package matching_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/matching"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThroughput(t *testing.T) {
+	require := require.New(t)
+
+	gcfg := model.GridConfig{
+		SkillCeil:   10,
+		LatencyCeil: 10,
+		Side:        2,
+	}
+	stats := matching.NewThroughput(gcfg, 10*time.Second)
+	now := time.Now().UTC()
+
+	_, known := stats.Estimate(now, model.BinIdx{S: 0, L: 0}, 0)
+	require.False(known)
+
+	match := schema.MatchResponse{
+		Skill:   schema.Candle{Average: 2.5},
+		Latency: schema.Candle{Average: 7.5},
+		Names:   []string{"a", "b", "c", "d"},
+	}
+	stats.Push(now, []schema.MatchResponse{match, match})
+
+	require.Equal(0.8, stats.Rate(now, model.BinIdx{S: 0, L: 1}))
+	require.Zero(stats.Rate(now, model.BinIdx{S: 0, L: 0}))
+
+	have, known := stats.Estimate(now, model.BinIdx{S: 0, L: 1}, 3)
+	require.True(known)
+	require.Equal(5*time.Second, have)
+
+	// the matches fall out of the window
+	later := now.Add(11 * time.Second)
+	require.Zero(stats.Rate(later, model.BinIdx{S: 0, L: 1}))
+
+	// the bins of the old grid are gone
+	stats.Push(now, []schema.MatchResponse{match})
+	gcfg.Side = 4
+	stats.Reconfigure(gcfg)
+	require.Zero(stats.Rate(now, model.BinIdx{S: 0, L: 1}))
+	stats.Push(now, []schema.MatchResponse{match})
+	require.Equal(0.4, stats.Rate(now, model.BinIdx{S: 1, L: 3}))
+}
@@ -0,0 +1,276 @@
+package matching
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/model"
+)
+
+// unit is a party or a user that has queued alone, the kernels never split it
+type unit []*model.QueuedUser
+
+// groupUnits collects the party members into units, in the order of their first appearance
+func groupUnits(users []*model.QueuedUser) []unit {
+	units := []unit{}
+	parties := make(map[string]int)
+
+	for _, user := range users {
+		if user.Party == "" {
+			units = append(units, unit{user})
+			continue
+		}
+
+		if idx, exists := parties[user.Party]; exists {
+			units[idx] = append(units[idx], user)
+			continue
+		}
+		parties[user.Party] = len(units)
+		units = append(units, unit{user})
+	}
+	return units
+}
+
+// packUnits fills groups of exactly MatchSize users, taking the units in their order.
+// A unit is skipped if the group could not be completed with it, or it is below the quality threshold.
+func (cfg *KernelConfig) packUnits(units []unit) [][]*model.QueuedUser {
+	size := cfg.MatchSize
+	now := time.Now().UTC()
+	groups := [][]*model.QueuedUser{}
+	used := make([]bool, len(units))
+	// computed once, every round only updates the rows its units have changed
+	reach := reachable(units, used, size)
+
+	for {
+		if !reach[0][size] {
+			return groups
+		}
+
+		taken := []int{}
+		group := []unit{}
+		need := size
+		for idx, members := range units {
+			if used[idx] || len(members) > need {
+				continue
+			}
+			// the units after idx are untouched in this round, so reach is still valid for them
+			rest := need - len(members)
+			if !reach[idx+1][rest] || !cfg.fits(append(group, members)) {
+				continue
+			}
+
+			used[idx] = true
+			taken = append(taken, idx)
+			group = append(group, members)
+			need = rest
+			if need == 0 {
+				break
+			}
+		}
+
+		if len(taken) == 0 {
+			return groups
+		}
+		if need > 0 || !cfg.accepts(flatten(group), now) {
+			// the first unit can't be completed into a group, the rest get another chance
+			for _, idx := range taken[1:] {
+				used[idx] = false
+			}
+			updateReach(reach, units, used, size, taken[0])
+			continue
+		}
+		groups = append(groups, flatten(group))
+		updateReach(reach, units, used, size, taken[len(taken)-1])
+	}
+}
+
+// fillGroup is packUnits for a single group, that must contain the first unit.
+// Returns nil if there is no such group, or it is below the quality threshold.
+func (cfg *KernelConfig) fillGroup(units []unit) []*model.QueuedUser {
+	size := cfg.MatchSize
+	if len(units) == 0 || len(units[0]) > size || !cfg.fits(units[:1]) {
+		return nil
+	}
+
+	used := make([]bool, len(units))
+	used[0] = true
+	reach := reachable(units, used, size)
+	need := size - len(units[0])
+	if !reach[1][need] {
+		return nil
+	}
+
+	group := []unit{units[0]}
+	for idx := 1; idx < len(units) && need > 0; idx++ {
+		members := units[idx]
+		if len(members) > need {
+			continue
+		}
+		rest := need - len(members)
+		if !reach[idx+1][rest] || !cfg.fits(append(group, members)) {
+			continue
+		}
+
+		group = append(group, members)
+		need = rest
+	}
+
+	if need > 0 || !cfg.accepts(flatten(group), time.Now().UTC()) {
+		return nil
+	}
+	return flatten(group)
+}
+
+// sweepWindows is the greedy pass of the kernels that look past the bins: every unit, the longest waiting first,
+// anchors a group of its nearest free units. The units are sorted by position once, an anchor only looks at
+// a window of its free neighbours on each side, then sorts them by distance.
+// form gets the candidates (the anchor first) and returns the group, or nil if there is none.
+// Once the deadline (if not zero) passes, the sweep stops after the first group, it never starves.
+// Returns the units of every formed group, and which units were taken.
+func (cfg *KernelConfig) sweepWindows(units []unit, position []float64, wait []float64, distance func(l int, r int) float64, form func([]unit) []*model.QueuedUser, deadline time.Time) ([][]unit, []bool) {
+	// the units are referred to by their indices, sorting and marking those is a lot cheaper
+	byPosition := make([]int, len(units))
+	for idx := range byPosition {
+		byPosition[idx] = idx
+	}
+	slices.SortFunc(byPosition, func(l int, r int) int {
+		return cmp.Or(cmp.Compare(position[l], position[r]), cmp.Compare(l, r))
+	})
+	rank := make([]int, len(units))
+	for pos, idx := range byPosition {
+		rank[idx] = pos
+	}
+	anchors := slices.Clone(byPosition)
+	slices.SortFunc(anchors, func(l int, r int) int {
+		return cmp.Or(cmp.Compare(wait[r], wait[l]), cmp.Compare(l, r))
+	})
+
+	// the free neighbours on each side of an anchor, enough for a couple of groups of single users
+	window := 2 * cfg.MatchSize
+	taken := make([]bool, len(units))
+	groups := [][]unit{}
+
+	for _, anchor := range anchors {
+		if taken[anchor] {
+			continue
+		}
+		if !deadline.IsZero() && len(groups) > 0 && time.Now().After(deadline) {
+			break
+		}
+
+		neighbours := []int{}
+		for pos, found := rank[anchor]-1, 0; pos >= 0 && found < window; pos-- {
+			if !taken[byPosition[pos]] {
+				neighbours = append(neighbours, byPosition[pos])
+				found++
+			}
+		}
+		for pos, found := rank[anchor]+1, 0; pos < len(byPosition) && found < window; pos++ {
+			if !taken[byPosition[pos]] {
+				neighbours = append(neighbours, byPosition[pos])
+				found++
+			}
+		}
+		distances := make(map[int]float64, len(neighbours))
+		for _, idx := range neighbours {
+			distances[idx] = distance(anchor, idx)
+		}
+		slices.SortFunc(neighbours, func(l int, r int) int {
+			return cmp.Or(cmp.Compare(distances[l], distances[r]), cmp.Compare(l, r))
+		})
+
+		candidates := []unit{units[anchor]}
+		for _, idx := range neighbours {
+			candidates = append(candidates, units[idx])
+		}
+		if unitsSize(candidates) < cfg.MatchSize {
+			continue
+		}
+		group := form(candidates)
+		if group == nil {
+			continue
+		}
+
+		grouped := make(map[string]struct{}, len(group))
+		for _, user := range group {
+			grouped[user.Name] = struct{}{}
+		}
+		picked := []unit{}
+		for _, idx := range append([]int{anchor}, neighbours...) {
+			if _, exists := grouped[units[idx][0].Name]; exists {
+				taken[idx] = true
+				picked = append(picked, units[idx])
+			}
+		}
+		groups = append(groups, picked)
+	}
+	return groups, taken
+}
+
+// fits reports whether a (partial) group can still be split into the teams, with a role for everyone
+func (cfg *KernelConfig) fits(group []unit) bool {
+	slots := cfg.teamSlots()
+	if cfg.TeamCount <= 1 {
+		return rolesFit(group, slots)
+	}
+
+	teamSize := cfg.MatchSize / cfg.TeamCount
+	teams := make([][]unit, cfg.TeamCount)
+	sums := make([]float64, cfg.TeamCount)
+	room := make([]int, cfg.TeamCount)
+	for t := range room {
+		room[t] = teamSize
+	}
+
+	sorted := slices.Clone(group)
+	slices.SortFunc(sorted, func(l unit, r unit) int {
+		return cmp.Compare(len(r), len(l))
+	})
+	return draftUnits(sorted, teams, sums, room, slots)
+}
+
+// reachable returns reach[i][s], whether the unused units[i:] can sum up to exactly s users
+func reachable(units []unit, used []bool, size int) [][]bool {
+	reach := make([][]bool, len(units)+1)
+	for idx := range reach {
+		reach[idx] = make([]bool, size+1)
+	}
+	reach[len(units)][0] = true
+
+	updateReach(reach, units, used, size, len(units)-1)
+	return reach
+}
+
+// updateReach recomputes the rows of reach from last down to the first, once the units up to last have changed.
+// The rows after last only depend on the units after it, so they are still valid
+func updateReach(reach [][]bool, units []unit, used []bool, size int, last int) {
+	for idx := last; idx >= 0; idx-- {
+		next := reach[idx+1]
+		curr := reach[idx]
+		copy(curr, next)
+
+		if !used[idx] {
+			width := len(units[idx])
+			for sum := width; sum <= size; sum++ {
+				curr[sum] = curr[sum] || next[sum-width]
+			}
+		}
+	}
+}
+
+func unitsSize(units []unit) int {
+	size := 0
+	for _, members := range units {
+		size += len(members)
+	}
+	return size
+}
+
+func flatten(units []unit) []*model.QueuedUser {
+	users := make([]*model.QueuedUser, 0, unitsSize(units))
+	for _, members := range units {
+		users = append(users, members...)
+	}
+	return users
+}
@@ -0,0 +1,39 @@
+package matching
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitsUpdateReach(t *testing.T) {
+	require := require.New(t)
+	size := 8
+
+	units := []unit{}
+	for idx := range 40 {
+		members := unit{}
+		for member := range 1 + rand.Intn(3) {
+			members = append(members, &model.QueuedUser{Name: fmt.Sprintf("user%d_%d", idx, member)})
+		}
+		units = append(units, members)
+	}
+	used := make([]bool, len(units))
+	reach := reachable(units, used, size)
+
+	// the updated rows are the same as the ones computed from scratch
+	for range 100 {
+		changed := []int{}
+		for range 1 + rand.Intn(4) {
+			idx := rand.Intn(len(units))
+			used[idx] = !used[idx]
+			changed = append(changed, idx)
+		}
+		updateReach(reach, units, used, size, slices.Max(changed))
+		require.Equal(reachable(units, used, size), reach)
+	}
+}
@@ -0,0 +1,161 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Axis maps a skill or a latency to [0, 1], which is then split into the bins of the grid.
+// The values that map outside of it are clamped into the first or the last bin
+type Axis interface {
+	Normalize(value float64, ceil float64) float64
+}
+
+// LinearAxis is value / ceil, everything above the ceil is piled into the last bin
+type LinearAxis struct{}
+
+func (LinearAxis) Normalize(value float64, ceil float64) float64 {
+	return value / ceil
+}
+
+// LogAxis is log(1 + value) / log(1 + ceil), the bins are narrow at the low end and wide at the high one
+type LogAxis struct{}
+
+func (LogAxis) Normalize(value float64, ceil float64) float64 {
+	return math.Log1p(max(0, value)) / math.Log1p(ceil)
+}
+
+// SoftAxis is value / (value + ceil), it never reaches 1: the ceil is in the middle of the grid,
+// and the bins get wider above it
+type SoftAxis struct{}
+
+func (SoftAxis) Normalize(value float64, ceil float64) float64 {
+	value = max(0, value)
+	return value / (value + ceil)
+}
+
+// the values a QuantileAxis remembers
+const quantileWindow = 1024
+
+// it's linear, until there are enough values to estimate the distribution
+const quantileMinimum = 64
+
+// QuantileAxis is the share of the recently observed values that are below the value,
+// so every bin gets about the same number of users. The distribution is local to the process
+type QuantileAxis struct {
+	mutex    sync.Mutex
+	observed []float64
+	// the next one to overwrite, once the window is full
+	next int
+}
+
+func NewQuantileAxis() *QuantileAxis {
+	return &QuantileAxis{
+		observed: make([]float64, 0, quantileWindow),
+	}
+}
+
+func (q *QuantileAxis) Observe(value float64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.observed) < quantileWindow {
+		q.observed = append(q.observed, value)
+		return
+	}
+	q.observed[q.next] = value
+	q.next = (q.next + 1) % quantileWindow
+}
+
+func (q *QuantileAxis) Normalize(value float64, ceil float64) float64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.observed) < quantileMinimum {
+		return value / ceil
+	}
+
+	// the equal values are counted as half below, so a crowd of them lands in the middle of its range
+	below := 0.0
+	for _, other := range q.observed {
+		if other < value {
+			below++
+		} else if other == value {
+			below += 0.5
+		}
+	}
+	return below / float64(len(q.observed))
+}
+
+// an axis that learns from the values
+type observer interface {
+	Observe(value float64)
+}
+
+func ParseAxis(name string) (Axis, error) {
+	switch name {
+	case "linear":
+		return LinearAxis{}, nil
+	case "log":
+		return LogAxis{}, nil
+	case "soft":
+		return SoftAxis{}, nil
+	case "quantile":
+		return NewQuantileAxis(), nil
+	default:
+		return nil, fmt.Errorf("unknown axis %q", name)
+	}
+}
+
+// axisName is the inverse of ParseAxis
+func axisName(axis Axis) (string, error) {
+	switch axis.(type) {
+	case nil, LinearAxis:
+		return "linear", nil
+	case LogAxis:
+		return "log", nil
+	case SoftAxis:
+		return "soft", nil
+	case *QuantileAxis:
+		return "quantile", nil
+	default:
+		return "", fmt.Errorf("unknown axis %T", axis)
+	}
+}
+
+func axisOrLinear(axis Axis) Axis {
+	if axis == nil {
+		return LinearAxis{}
+	}
+	return axis
+}
+
+// observe feeds the users to the axes that learn from them, before they are placed into the grid
+func (cfg *GridConfig) observe(users []*QueuedUser) {
+	for _, user := range users {
+		if axis, ok := cfg.SkillAxis.(observer); ok {
+			axis.Observe(user.Skill)
+		}
+		if axis, ok := cfg.LatencyAxis.(observer); ok {
+			axis.Observe(user.Latency)
+		}
+	}
+}
+
+// Clone copies the config with new instances of the axes that learn,
+// so that a grid only observes its own users
+func (cfg *GridConfig) Clone() GridConfig {
+	clone := *cfg
+	clone.SkillAxis = freshAxis(cfg.SkillAxis)
+	clone.LatencyAxis = freshAxis(cfg.LatencyAxis)
+	return clone
+}
+
+func freshAxis(axis Axis) Axis {
+	if _, learns := axis.(*QuantileAxis); learns {
+		return NewQuantileAxis()
+	}
+	// the rest have no state to share
+	return axis
+}
@@ -0,0 +1,87 @@
+package model_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAxes(t *testing.T) {
+	ceil := 1000.0
+	for _, name := range []string{"linear", "log", "soft"} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			axis, err := model.ParseAxis(name)
+			require.Nil(err)
+
+			require.InDelta(0, axis.Normalize(0, ceil), 1e-9)
+			prev := -1.0
+			for value := 0.0; value <= 10*ceil; value += 100 {
+				curr := axis.Normalize(value, ceil)
+				require.Greater(curr, prev, value)
+				prev = curr
+			}
+		})
+	}
+
+	require := require.New(t)
+	require.InDelta(1, model.LogAxis{}.Normalize(ceil, ceil), 1e-9)
+	require.InDelta(0.5, model.SoftAxis{}.Normalize(ceil, ceil), 1e-9)
+	// no longer piled up at the ceil
+	require.Less(model.SoftAxis{}.Normalize(10*ceil, ceil), 1.0)
+
+	_, err := model.ParseAxis("sqrt")
+	require.NotNil(err)
+}
+
+func TestQuantileAxis(t *testing.T) {
+	require := require.New(t)
+	axis := model.NewQuantileAxis()
+
+	// linear until there are enough values
+	require.InDelta(0.5, axis.Normalize(500, 1000), 1e-9)
+
+	// a skewed distribution, most of the users are below 100
+	for value := range 2000 {
+		axis.Observe(float64(value % 100))
+		if value%10 == 0 {
+			axis.Observe(float64(value))
+		}
+	}
+	require.Less(axis.Normalize(0, 1000), 0.05)
+	require.InDelta(0.5, axis.Normalize(50, 1000), 0.1)
+	require.Greater(axis.Normalize(1500, 1000), 0.95)
+}
+
+func TestUserQueueAxes(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		gcfg := model.GridConfig{
+			SkillCeil:   1000,
+			LatencyCeil: 1000,
+			Side:        4,
+			SkillAxis:   model.SoftAxis{},
+		}
+		users := factory(t, gcfg)
+		require := require.New(t)
+
+		// both are above the ceil, linearly they would share the last bin
+		high := &model.QueuedUser{Name: "high", Skill: 2000, Latency: 100, QueuedAt: now()}
+		higher := &model.QueuedUser{Name: "higher", Skill: 5000, Latency: 100, QueuedAt: now()}
+		require.Nil(users.Add(ctx, high))
+		require.Nil(users.Add(ctx, higher))
+
+		for s, want := range []string{"", "", "high", "higher"} {
+			bin, err := users.GetBin(ctx, model.BinIdx{S: s, L: 0})
+			require.Nil(err)
+			if want == "" {
+				require.Empty(bin, fmt.Sprint(s))
+				continue
+			}
+			require.Len(bin, 1)
+			require.Equal(want, bin[0].Name)
+		}
+		require.Equal(model.BinIdx{S: 3, L: 0}, gcfg.ToIndex(higher))
+	})
+}
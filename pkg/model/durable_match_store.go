@@ -0,0 +1,122 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+const matchLogFile = "matches.log"
+
+// NewMatchStoreDurable is the inmemory store, with every match appended to a log in the dir.
+// The log is replayed on the startup, so the serials continue from the last one
+func NewMatchStoreDurable(dir string) (MatchStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &durableMatchStore{
+		inmemoryMatchStore: NewMatchStoreInmemory().(*inmemoryMatchStore),
+	}
+
+	path := filepath.Join(dir, matchLogFile)
+	valid, err := m.replay(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	m.log, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// a match cut off by a crash is dropped, the new ones are appended after the last whole one
+	err = m.log.Truncate(valid)
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.log.Seek(valid, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// the reads are served by the inmemory store as they are
+type durableMatchStore struct {
+	*inmemoryMatchStore
+	log *os.File
+}
+
+// replay stores the matches of the log, returns the offset after the last whole one
+func (m *durableMatchStore) replay(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	valid := int64(0)
+	for {
+		var match schema.MatchResponse
+		err := decoder.Decode(&match)
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err != nil {
+			log.Printf("%s: dropped the matches after %d bytes, %v\n", path, valid, err)
+			return valid, nil
+		}
+		if match.Serial != m.serial+1 {
+			return 0, fmt.Errorf("%s: serial %d after %d", path, match.Serial, m.serial)
+		}
+		valid = decoder.InputOffset()
+
+		m.store(&match)
+	}
+}
+
+// Add logs the match before storing it, so a serial that has been handed out is never handed out again
+func (m *durableMatchStore) Add(_ context.Context, match *schema.MatchResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next := *match
+	next.Serial = m.serial + 1
+	line, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	err = appendLine(m.log, line)
+	if err != nil {
+		return err
+	}
+
+	m.store(&next)
+	match.Serial = next.Serial
+	return nil
+}
+
+// appendLine writes a line at the end of the log, a line that failed halfway is cut off
+func appendLine(file *os.File, line []byte) error {
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err == nil {
+		return nil
+	}
+
+	_ = file.Truncate(offset)
+	_, _ = file.Seek(offset, io.SeekStart)
+	return err
+}
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+)
+
+const settingsFile = "settings.json"
+
+// NewSettingsStoreDurable is the inmemory store, with the settings of every queue written to a file in the dir
+func NewSettingsStoreDurable(dir string) (SettingsStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &durableSettingsStore{
+		inmemorySettingsStore: NewSettingsStoreInmemory().(*inmemorySettingsStore),
+		path:                  filepath.Join(dir, settingsFile),
+	}
+
+	raw, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &m.queues)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type durableSettingsStore struct {
+	*inmemorySettingsStore
+	path string
+}
+
+// Save replaces the whole file, it is written aside and renamed over the old one, so a crash leaves either of them
+func (m *durableSettingsStore) Save(_ context.Context, queue string, settings map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queues := maps.Clone(m.queues)
+	queues[queue] = maps.Clone(settings)
+	raw, err := json.Marshal(queues)
+	if err != nil {
+		return err
+	}
+
+	temp := m.path + ".tmp"
+	err = os.WriteFile(temp, raw, 0o644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temp, m.path)
+	if err != nil {
+		return err
+	}
+
+	m.queues = queues
+	return nil
+}
@@ -0,0 +1,414 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walFile      = "queue.wal"
+	snapshotFile = "queue.snapshot"
+)
+
+// a change of the queue, as it is appended to the log
+type walRecord struct {
+	// either "add", "remove", "delete" (of the older logs), "heartbeat" or "reconfigure"
+	Op string
+	// add: a user, or the members of a party
+	Users []*QueuedUser `json:",omitempty"`
+	// remove: the users, delete and heartbeat: the user and their party
+	Names []string `json:",omitempty"`
+	// heartbeat: when the user was seen
+	At *time.Time `json:",omitempty"`
+	// reconfigure: the new grid
+	Grid *walGrid `json:",omitempty"`
+	// reconfigure: the new grid, as it is passed to the journal
+	cfg *GridConfig
+}
+
+// a grid config, with the axes by their names
+type walGrid struct {
+	SkillCeil      float64
+	LatencyCeil    float64
+	Side           int
+	PartyAggregate PartyAggregate
+	SkillAxis      string
+	LatencyAxis    string
+}
+
+func newWalGrid(cfg *GridConfig) (*walGrid, error) {
+	skillAxis, err := axisName(cfg.SkillAxis)
+	if err != nil {
+		return nil, err
+	}
+	latencyAxis, err := axisName(cfg.LatencyAxis)
+	if err != nil {
+		return nil, err
+	}
+	return &walGrid{
+		SkillCeil:      cfg.SkillCeil,
+		LatencyCeil:    cfg.LatencyCeil,
+		Side:           cfg.Side,
+		PartyAggregate: cfg.PartyAggregate,
+		SkillAxis:      skillAxis,
+		LatencyAxis:    latencyAxis,
+	}, nil
+}
+
+// config makes the axes anew, the ones that learn start over
+func (g *walGrid) config() (GridConfig, error) {
+	if g.Side <= 0 || g.SkillCeil <= 0 || g.LatencyCeil <= 0 {
+		return GridConfig{}, fmt.Errorf("invalid grid %+v", *g)
+	}
+	skillAxis, err := ParseAxis(g.SkillAxis)
+	if err != nil {
+		return GridConfig{}, err
+	}
+	latencyAxis, err := ParseAxis(g.LatencyAxis)
+	if err != nil {
+		return GridConfig{}, err
+	}
+	return GridConfig{
+		SkillCeil:      g.SkillCeil,
+		LatencyCeil:    g.LatencyCeil,
+		Side:           g.Side,
+		PartyAggregate: g.PartyAggregate,
+		SkillAxis:      skillAxis,
+		LatencyAxis:    latencyAxis,
+	}, nil
+}
+
+// validate checks that the record has everything its op needs, a record without it is corrupted
+func (r *walRecord) validate() error {
+	switch r.Op {
+	case "add":
+		if len(r.Users) == 0 {
+			return errors.New("add without users")
+		}
+		for _, user := range r.Users {
+			if user == nil || user.Name == "" {
+				return errors.New("add of a user without a name")
+			}
+		}
+	case "remove":
+	case "delete":
+		if len(r.Names) != 1 {
+			return errors.New("delete without a user")
+		}
+	case "heartbeat":
+		if len(r.Names) != 1 || r.At == nil {
+			return errors.New("heartbeat without a user or a time")
+		}
+	case "reconfigure":
+		if r.Grid == nil {
+			return errors.New("reconfigure without a grid")
+		}
+		_, err := r.Grid.config()
+		return err
+	default:
+		return fmt.Errorf("unknown op %q", r.Op)
+	}
+	return nil
+}
+
+// NewUserQueueDurable is the inmemory queue, with every change appended to a log in the dir before it is applied.
+// The log is compacted into a snapshot every compactEvery changes, both are replayed on the startup.
+// The records are not synced to the disk one by one, so the queue survives a crash of the service,
+// but not necessarily of the machine
+func NewUserQueueDurable(cfg GridConfig, dir string, compactEvery int) (UserQueue, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &durableUserQueue{
+		inmemoryUserQueue: NewUserQueueInmemory(cfg).(*inmemoryUserQueue),
+		dir:               dir,
+		compactEvery:      max(1, compactEvery),
+	}
+
+	_, snapshotGrid, err := m.replay(filepath.Join(dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	valid, lastGrid, err := m.replay(filepath.Join(dir, walFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if lastGrid == nil {
+		lastGrid = snapshotGrid
+	}
+
+	m.wal, err = os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// a record cut off by a crash is dropped, the new ones are appended after the last whole one
+	err = m.wal.Truncate(valid)
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.wal.Seek(valid, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	m.journal = m.append
+
+	// the users are replayed into the logged grids, and moved into the one the queue is made with if it differs
+	if lastGrid != nil {
+		grid, err := newWalGrid(&cfg)
+		if err != nil || *grid != *lastGrid {
+			err = m.Reconfigure(context.Background(), cfg)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// the reads are served by the inmemory queue as they are, the changes are logged by its journal
+type durableUserQueue struct {
+	*inmemoryUserQueue
+	dir          string
+	compactEvery int
+
+	// held while a record is appended. The changes of the same users are logged in the order they are applied in,
+	// as the journal is called with the locks of the change held
+	mutex   sync.Mutex
+	wal     *os.File
+	records int
+}
+
+// replay applies the records of the file, returns the offset after the last whole record, and the last grid
+// reconfigured to, if any. The records are replayed over the state they may have already been applied to (after a crash
+// during a compaction), then the adds of the existing users fail, and the removes of the missing ones do nothing
+func (m *durableUserQueue) replay(path string) (int64, *walGrid, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	ctx := context.Background()
+	decoder := json.NewDecoder(file)
+	valid := int64(0)
+	var lastGrid *walGrid
+	for {
+		var record walRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return valid, lastGrid, nil
+		}
+		if err != nil {
+			log.Printf("%s: dropped the records after %d bytes, %v\n", path, valid, err)
+			return valid, lastGrid, nil
+		}
+		err = record.validate()
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: the record after %d bytes, %w", path, valid, err)
+		}
+		valid = decoder.InputOffset()
+
+		switch record.Op {
+		case "add":
+			err = m.inmemoryUserQueue.addUnit(ctx, record.Users)
+		case "remove":
+			err = m.inmemoryUserQueue.Remove(ctx, record.Names)
+		case "delete":
+			err = m.inmemoryUserQueue.Delete(ctx, record.Names[0])
+		case "heartbeat":
+			err = m.inmemoryUserQueue.heartbeat(record.Names[0], *record.At)
+		case "reconfigure":
+			// checked by validate
+			grid, _ := record.Grid.config()
+			err = m.inmemoryUserQueue.Reconfigure(ctx, grid)
+			lastGrid = record.Grid
+		}
+		if err != nil && !errors.Is(err, ErrNotQueued) {
+			log.Printf("%s: skipped a record, %v\n", path, err)
+		}
+	}
+}
+
+// addUnit adds a user that has queued alone, or the members of a party
+func (m *inmemoryUserQueue) addUnit(ctx context.Context, users []*QueuedUser) error {
+	if len(users) == 1 && users[0].Party == "" {
+		return m.Add(ctx, users[0])
+	}
+	return m.AddParty(ctx, users)
+}
+
+// append is the journal of the inmemory queue, the change is not applied if it fails
+func (m *durableUserQueue) append(record walRecord) error {
+	if record.cfg != nil {
+		grid, err := newWalGrid(record.cfg)
+		if err != nil {
+			return err
+		}
+		record.Grid = grid
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err = appendLine(m.wal, line)
+	if err != nil {
+		return err
+	}
+	m.records++
+	return nil
+}
+
+// compactIfDue compacts the log once it has enough records, after the changes in progress.
+// A failed compaction is retried after the next change
+func (m *durableUserQueue) compactIfDue() {
+	m.mutex.Lock()
+	due := m.records >= m.compactEvery
+	m.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	// every change holds the grid for reading, so none is logged meanwhile
+	m.grid.Lock()
+	defer m.grid.Unlock()
+
+	// compacted by another change meanwhile
+	m.mutex.Lock()
+	due = m.records >= m.compactEvery
+	m.mutex.Unlock()
+	if !due {
+		return
+	}
+	err := m.compact()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// compact writes the grid and the queued users into a new snapshot, then empties the log.
+// The grid must be locked for writing
+func (m *durableUserQueue) compact() error {
+	path := filepath.Join(m.dir, snapshotFile)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+
+	grid, err := newWalGrid(&m.cfg)
+	if err != nil {
+		return err
+	}
+	err = encoder.Encode(walRecord{Op: "reconfigure", Grid: grid})
+	if err != nil {
+		return err
+	}
+
+	// the party members are added together
+	units := [][]*QueuedUser{}
+	parties := make(map[string]int)
+	for _, user := range m.all() {
+		if user.Party == "" {
+			units = append(units, []*QueuedUser{user})
+			continue
+		}
+		if idx, exists := parties[user.Party]; exists {
+			units[idx] = append(units[idx], user)
+			continue
+		}
+		parties[user.Party] = len(units)
+		units = append(units, []*QueuedUser{user})
+	}
+
+	for _, users := range units {
+		err := encoder.Encode(walRecord{Op: "add", Users: users})
+		if err != nil {
+			return err
+		}
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	err = m.wal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = m.wal.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.records = 0
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *durableUserQueue) Add(ctx context.Context, user *QueuedUser) error {
+	err := m.inmemoryUserQueue.Add(ctx, user)
+	m.compactIfDue()
+	return err
+}
+
+func (m *durableUserQueue) AddParty(ctx context.Context, members []*QueuedUser) error {
+	err := m.inmemoryUserQueue.AddParty(ctx, members)
+	m.compactIfDue()
+	return err
+}
+
+func (m *durableUserQueue) Remove(ctx context.Context, users []string) error {
+	err := m.inmemoryUserQueue.Remove(ctx, users)
+	m.compactIfDue()
+	return err
+}
+
+func (m *durableUserQueue) Claim(ctx context.Context, users []string) (bool, error) {
+	claimed, err := m.inmemoryUserQueue.Claim(ctx, users)
+	m.compactIfDue()
+	return claimed, err
+}
+
+func (m *durableUserQueue) Delete(ctx context.Context, name string) error {
+	err := m.inmemoryUserQueue.Delete(ctx, name)
+	m.compactIfDue()
+	return err
+}
+
+func (m *durableUserQueue) Heartbeat(ctx context.Context, name string) error {
+	err := m.inmemoryUserQueue.Heartbeat(ctx, name)
+	m.compactIfDue()
+	return err
+}
+
+func (m *durableUserQueue) Expire(ctx context.Context, before time.Time) ([]string, error) {
+	names, err := m.inmemoryUserQueue.Expire(ctx, before)
+	m.compactIfDue()
+	return names, err
+}
+
+func (m *durableUserQueue) Reconfigure(ctx context.Context, cfg GridConfig) error {
+	err := m.inmemoryUserQueue.Reconfigure(ctx, cfg)
+	m.compactIfDue()
+	return err
+}
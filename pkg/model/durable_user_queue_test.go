@@ -0,0 +1,220 @@
+package model_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+// requireSameQueue checks that the restarted queue has the same users in the same bins
+func requireSameQueue(t *testing.T, want model.UserQueue, have model.UserQueue) {
+	require := require.New(t)
+
+	wantCount, err := want.Count(ctx)
+	require.Nil(err)
+	haveCount, err := have.Count(ctx)
+	require.Nil(err)
+	require.Equal(wantCount, haveCount)
+
+	for s := range cfg.Side {
+		for l := range cfg.Side {
+			wantBin, err := want.GetBin(ctx, model.BinIdx{S: s, L: l})
+			require.Nil(err)
+			haveBin, err := have.GetBin(ctx, model.BinIdx{S: s, L: l})
+			require.Nil(err)
+			require.Len(haveBin, len(wantBin))
+			for _, user := range wantBin {
+				require.True(binContains(haveBin, user), user.Name)
+			}
+		}
+	}
+}
+
+func TestUserQueueDurable(t *testing.T) {
+	for _, compactEvery := range []int{1000, 3} {
+		t.Run(fmt.Sprintf("compact%d", compactEvery), func(t *testing.T) {
+			require := require.New(t)
+			dir := t.TempDir()
+
+			users, err := model.NewUserQueueDurable(cfg, dir, compactEvery)
+			require.Nil(err)
+			for _, user := range wantUsers {
+				require.Nil(users.Add(ctx, user))
+			}
+			party := []*model.QueuedUser{
+				{Name: "member0", Skill: 1, Latency: 1, QueuedAt: now(), Party: "party0", Roles: []string{"tank"}},
+				{Name: "member1", Skill: 9, Latency: 1, QueuedAt: now(), Party: "party0", Latencies: map[string]float64{"eu": 1}},
+			}
+			require.Nil(users.AddParty(ctx, party))
+
+			require.Nil(users.Remove(ctx, []string{wantUsers[0].Name}))
+			require.Nil(users.Delete(ctx, wantUsers[1].Name))
+			claimed, err := users.Claim(ctx, []string{wantUsers[2].Name, wantUsers[3].Name})
+			require.Nil(err)
+			require.True(claimed)
+
+			// the failed changes are not logged
+			require.Error(users.Add(ctx, wantUsers[4]))
+
+			restarted, err := model.NewUserQueueDurable(cfg, dir, compactEvery)
+			require.Nil(err)
+			requireSameQueue(t, users, restarted)
+
+			// the party still leaves together
+			require.Nil(restarted.Delete(ctx, "member0"))
+			count, err := restarted.Count(ctx)
+			require.Nil(err)
+			require.Equal(len(wantUsers)-4, count)
+
+			again, err := model.NewUserQueueDurable(cfg, dir, compactEvery)
+			require.Nil(err)
+			requireSameQueue(t, restarted, again)
+
+			if compactEvery == 3 {
+				_, err := os.Stat(filepath.Join(dir, "queue.snapshot"))
+				require.Nil(err)
+			}
+		})
+	}
+}
+
+func TestUserQueueDurableTornRecord(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	users, err := model.NewUserQueueDurable(cfg, dir, 1000)
+	require.Nil(err)
+	require.Nil(users.Add(ctx, wantUsers[0]))
+
+	// a crash in the middle of a record
+	wal, err := os.OpenFile(filepath.Join(dir, "queue.wal"), os.O_APPEND|os.O_WRONLY, 0)
+	require.Nil(err)
+	_, err = wal.WriteString(`{"Op":"add","Users":[{"Name":"us`)
+	require.Nil(err)
+	require.Nil(wal.Close())
+
+	restarted, err := model.NewUserQueueDurable(cfg, dir, 1000)
+	require.Nil(err)
+	requireSameQueue(t, users, restarted)
+
+	// the new records are not lost behind the torn one
+	require.Nil(restarted.Add(ctx, wantUsers[1]))
+	again, err := model.NewUserQueueDurable(cfg, dir, 1000)
+	require.Nil(err)
+	requireSameQueue(t, restarted, again)
+
+	count, err := again.Count(ctx)
+	require.Nil(err)
+	require.Equal(2, count)
+}
+
+func TestUserQueueDurableHeartbeat(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	users, err := model.NewUserQueueDurable(cfg, dir, 1000)
+	require.Nil(err)
+	require.Nil(users.Add(ctx, wantUsers[0]))
+	require.Nil(users.Add(ctx, wantUsers[1]))
+	require.Nil(users.Heartbeat(ctx, wantUsers[1].Name))
+
+	// the heartbeat is not lost
+	restarted, err := model.NewUserQueueDurable(cfg, dir, 1000)
+	require.Nil(err)
+	expired, err := restarted.Expire(ctx, now().Add(-50*time.Second))
+	require.Nil(err)
+	require.Equal([]string{wantUsers[0].Name}, expired)
+
+	// neither is the expiry
+	again, err := model.NewUserQueueDurable(cfg, dir, 1000)
+	require.Nil(err)
+	requireSameQueue(t, restarted, again)
+	count, err := again.Count(ctx)
+	require.Nil(err)
+	require.Equal(1, count)
+}
+
+// requireSameGrid checks that the queues have the same users in the same bins, on any grid
+func requireSameGrid(t *testing.T, want model.UserQueue, have model.UserQueue) {
+	require := require.New(t)
+
+	wantGrid, err := want.GetGrid(ctx, 0)
+	require.Nil(err)
+	haveGrid, err := have.GetGrid(ctx, 0)
+	require.Nil(err)
+	require.Len(haveGrid, len(wantGrid))
+	for idx, bin := range wantGrid {
+		require.Len(haveGrid[idx], len(bin), idx)
+		for _, user := range bin {
+			require.True(binContains(haveGrid[idx], user), user.Name)
+		}
+	}
+}
+
+func TestUserQueueDurableReconfigure(t *testing.T) {
+	for _, compactEvery := range []int{1000, 2} {
+		t.Run(fmt.Sprintf("compact%d", compactEvery), func(t *testing.T) {
+			require := require.New(t)
+			dir := t.TempDir()
+			finer := model.GridConfig{
+				SkillCeil:   10,
+				LatencyCeil: 10,
+				Side:        4,
+				SkillAxis:   model.LogAxis{},
+			}
+
+			users, err := model.NewUserQueueDurable(cfg, dir, compactEvery)
+			require.Nil(err)
+			for _, user := range wantUsers[:5] {
+				require.Nil(users.Add(ctx, user))
+			}
+			require.Nil(users.Reconfigure(ctx, finer))
+			// placed by the new grid, and replayed into it
+			require.Nil(users.Add(ctx, wantUsers[5]))
+
+			restarted, err := model.NewUserQueueDurable(finer, dir, compactEvery)
+			require.Nil(err)
+			requireSameGrid(t, users, restarted)
+
+			// made with another grid, the users are moved into it
+			coarse, err := model.NewUserQueueDurable(cfg, dir, compactEvery)
+			require.Nil(err)
+			want := model.NewUserQueueInmemory(cfg)
+			for _, user := range wantUsers[:6] {
+				require.Nil(want.Add(ctx, user))
+			}
+			requireSameQueue(t, want, coarse)
+
+			// and stay there
+			again, err := model.NewUserQueueDurable(cfg, dir, compactEvery)
+			require.Nil(err)
+			requireSameQueue(t, coarse, again)
+		})
+	}
+}
+
+func TestUserQueueDurableCorrupted(t *testing.T) {
+	for _, record := range []string{
+		`{"Op":"add"}`,
+		`{"Op":"add","Users":[{"Skill":1}]}`,
+		`{"Op":"delete"}`,
+		`{"Op":"heartbeat","Names":["bob"]}`,
+		`{"Op":"reconfigure"}`,
+		`{"Op":"reconfigure","Grid":{"SkillCeil":10,"LatencyCeil":10,"Side":2,"SkillAxis":"cubic","LatencyAxis":"linear"}}`,
+		`{"Op":"promote","Names":["bob"]}`,
+	} {
+		t.Run(record, func(t *testing.T) {
+			dir := t.TempDir()
+			err := os.WriteFile(filepath.Join(dir, "queue.wal"), []byte(record+"\n"), 0o644)
+			require.Nil(t, err)
+
+			_, err = model.NewUserQueueDurable(cfg, dir, 1000)
+			require.Error(t, err)
+		})
+	}
+}
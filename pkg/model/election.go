@@ -0,0 +1,26 @@
+package model
+
+import "context"
+
+// Election decides which of the instances runs the matching of a queue, the rest only serve the requests.
+// The queues are led independently, so they may spread over the instances
+type Election interface {
+	// Lead returns true while this instance leads the queue, it is called on every tick.
+	// A follower takes over once the leader is gone
+	Lead(ctx context.Context, queue string) (bool, error)
+	// Resign gives up every queue on a shutdown, so a follower doesn't wait for the leader to time out
+	Resign()
+}
+
+// NewElectionInmemory always leads, the inmemory storage is not shared with the other instances anyway
+func NewElectionInmemory() Election {
+	return inmemoryElection{}
+}
+
+type inmemoryElection struct{}
+
+func (inmemoryElection) Lead(context.Context, string) (bool, error) {
+	return true, nil
+}
+
+func (inmemoryElection) Resign() {}
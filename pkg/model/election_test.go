@@ -0,0 +1,72 @@
+package model_test
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElection(t *testing.T) {
+	t.Run("inmem", func(t *testing.T) {
+		require := require.New(t)
+		election := model.NewElectionInmemory()
+
+		lead, err := election.Lead(ctx, model.DefaultQueue)
+		require.Nil(err)
+		require.True(lead)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		require := require.New(t)
+		// the instances have their own pools
+		first, err := pgxpool.New(ctx, dbUrl)
+		require.Nil(err)
+		defer first.Close()
+		second, err := pgxpool.New(ctx, dbUrl)
+		require.Nil(err)
+		defer second.Close()
+
+		leader := model.NewElectionPostgres(first)
+		follower := model.NewElectionPostgres(second)
+		// the pools wait for the connections of the elections
+		defer leader.Resign()
+		defer follower.Resign()
+
+		lead, err := leader.Lead(ctx, "ranked")
+		require.Nil(err)
+		require.True(lead)
+		// still leading on the next tick
+		lead, err = leader.Lead(ctx, "ranked")
+		require.Nil(err)
+		require.True(lead)
+
+		lead, err = follower.Lead(ctx, "ranked")
+		require.Nil(err)
+		require.False(lead)
+
+		// the connection of the leader dies, the only one holding the locks, the follower takes over
+		_, err = second.Exec(ctx, `
+			select pg_terminate_backend(pid)
+			from pg_locks
+			where locktype = 'advisory' and pid <> pg_backend_pid()`)
+		require.Nil(err)
+		lead, err = follower.Lead(ctx, "ranked")
+		require.Nil(err)
+		require.True(lead)
+
+		// the old leader notices, and then follows
+		lead, err = leader.Lead(ctx, "ranked")
+		require.Error(err)
+		require.False(lead)
+		lead, err = leader.Lead(ctx, "ranked")
+		require.Nil(err)
+		require.False(lead)
+
+		// the queues are led independently
+		lead, err = leader.Lead(ctx, "casual")
+		require.Nil(err)
+		require.True(lead)
+	})
+}
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+func NewMatchStoreInmemory() MatchStore {
+	return &inmemoryMatchStore{
+		matches: make(map[int]*schema.MatchResponse),
+		byUser:  make(map[string][]int),
+	}
+}
+
+// the serials restart from 1 along with the service
+type inmemoryMatchStore struct {
+	mu      sync.Mutex
+	serial  int
+	matches map[int]*schema.MatchResponse
+	byUser  map[string][]int // name -> ascending serials
+}
+
+func (m *inmemoryMatchStore) Add(_ context.Context, match *schema.MatchResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	match.Serial = m.serial + 1
+	m.store(match)
+	return nil
+}
+
+// store keeps the match under its serial, the next one. The mutex must be held
+func (m *inmemoryMatchStore) store(match *schema.MatchResponse) {
+	m.serial = match.Serial
+
+	stored := m.clone(match)
+	m.matches[stored.Serial] = &stored
+	for _, name := range stored.Names {
+		m.byUser[name] = append(m.byUser[name], stored.Serial)
+	}
+}
+
+func (m *inmemoryMatchStore) Get(_ context.Context, serial int) (*schema.MatchResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, exists := m.matches[serial]
+	if !exists {
+		return nil, ErrNoMatch
+	}
+
+	match := m.clone(stored)
+	return &match, nil
+}
+
+func (m *inmemoryMatchStore) List(_ context.Context, since int, limit int) ([]schema.MatchResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	matches := []schema.MatchResponse{}
+	for serial := max(since, 0) + 1; serial <= m.serial && len(matches) < limit; serial++ {
+		matches = append(matches, m.clone(m.matches[serial]))
+	}
+	return matches, nil
+}
+
+func (m *inmemoryMatchStore) ListUser(_ context.Context, name string, since int, limit int) ([]schema.MatchResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	serials := m.byUser[name]
+	first, _ := slices.BinarySearch(serials, since+1)
+
+	matches := []schema.MatchResponse{}
+	for _, serial := range serials[first:] {
+		if len(matches) >= limit {
+			break
+		}
+		matches = append(matches, m.clone(m.matches[serial]))
+	}
+	return matches, nil
+}
+
+func (m *inmemoryMatchStore) clone(stored *schema.MatchResponse) schema.MatchResponse {
+	match := *stored
+	match.Names = slices.Clone(stored.Names)
+	match.Teams = slices.Clone(stored.Teams)
+	match.Roles = maps.Clone(stored.Roles)
+	return match
+}
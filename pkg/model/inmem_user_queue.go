@@ -2,52 +2,196 @@ package model
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"math"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/starnuik/golang_match/pkg/schema"
 )
 
+// the stripes of the bins and of the names, each is locked separately
+const inmemStripes = 64
+
+// NewUserQueueInmemory is safe for concurrent use, the bins and the names are split into stripes with their own locks
 func NewUserQueueInmemory(cfg GridConfig) UserQueue {
-	return &inmemoryUserQueue{
-		cfg:  cfg,
-		bins: make(map[BinIdx]map[string]*QueuedUser),
+	m := &inmemoryUserQueue{
+		cfg:     cfg,
+		parties: make(map[string]BinIdx),
+	}
+	for idx := range m.bins {
+		m.bins[idx].bins = make(map[BinIdx]map[string]*QueuedUser)
+	}
+	for idx := range m.names {
+		m.names[idx].index = make(map[string]BinIdx)
 	}
+	return m
 }
 
+// the locks are taken in the order: grid, names (by the stripe), parties, bins (by the stripe).
+// The journal takes none of them
 type inmemoryUserQueue struct {
+	// held for reading by every operation, and for writing while the users are moved into a new grid
+	grid sync.RWMutex
 	cfg  GridConfig
-	bins map[BinIdx]map[string]*QueuedUser
+
+	names [inmemStripes]nameStripe
+
+	partyMutex sync.Mutex
+	parties    map[string]BinIdx // party -> bin
+
+	bins [inmemStripes]binStripe
+
+	// gets every change with its locks held, before it is applied. The change is dropped if it fails
+	journal func(walRecord) error
+}
+
+type nameStripe struct {
+	mutex sync.RWMutex
+	index map[string]BinIdx // name -> bin
+}
+
+type binStripe struct {
+	mutex sync.RWMutex
+	bins  map[BinIdx]map[string]*QueuedUser
+}
+
+func (m *inmemoryUserQueue) nameStripe(name string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return int(hash.Sum32() % inmemStripes)
+}
+
+func (m *inmemoryUserQueue) binStripe(idx BinIdx) *binStripe {
+	// the neighbouring bins land into different stripes
+	stripe := (idx.S*31 + idx.L) % inmemStripes
+	if stripe < 0 {
+		stripe += inmemStripes
+	}
+	return &m.bins[stripe]
+}
+
+// lockNames locks the stripes of the names in order, returns the unlock
+func (m *inmemoryUserQueue) lockNames(names []string) func() {
+	stripes := make([]int, 0, len(names))
+	for _, name := range names {
+		stripes = append(stripes, m.nameStripe(name))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	for _, stripe := range stripes {
+		m.names[stripe].mutex.Lock()
+	}
+	return func() {
+		for _, stripe := range stripes {
+			m.names[stripe].mutex.Unlock()
+		}
+	}
+}
+
+// commit passes the change to the journal, if there is one
+func (m *inmemoryUserQueue) commit(record walRecord) error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal(record)
+}
+
+// lookup is the bin of the user, the name stripe must not be locked
+func (m *inmemoryUserQueue) lookup(name string) (BinIdx, bool) {
+	stripe := &m.names[m.nameStripe(name)]
+	stripe.mutex.RLock()
+	defer stripe.mutex.RUnlock()
+
+	idx, exists := stripe.index[name]
+	return idx, exists
 }
 
 func (m *inmemoryUserQueue) Parse(req *schema.QueueUserRequest) (*QueuedUser, error) {
 	return parse(req)
 }
 
+func (m *inmemoryUserQueue) ParseParty(req *schema.QueuePartyRequest) ([]*QueuedUser, error) {
+	return parseParty(req)
+}
+
 func (m *inmemoryUserQueue) Add(_ context.Context, user *QueuedUser) error {
-	idx := m.toIndex(user)
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	m.cfg.observe([]*QueuedUser{user})
+	return m.insert([]*QueuedUser{user}, toIndex(user, &m.cfg))
+}
+
+func (m *inmemoryUserQueue) AddParty(_ context.Context, members []*QueuedUser) error {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
 
-	if _, exists := m.bins[idx]; !exists {
-		m.bins[idx] = make(map[string]*QueuedUser)
+	m.cfg.observe(members)
+	return m.insert(members, partyIndex(members, &m.cfg))
+}
+
+func (m *inmemoryUserQueue) insert(users []*QueuedUser, idx BinIdx) error {
+	names := make([]string, 0, len(users))
+	for _, user := range users {
+		names = append(names, user.Name)
 	}
+	unlock := m.lockNames(names)
+	defer unlock()
 
-	bin := m.bins[idx]
+	m.partyMutex.Lock()
+	defer m.partyMutex.Unlock()
 
-	if _, exists := bin[user.Name]; exists {
-		return fmt.Errorf("user already exists")
+	for _, user := range users {
+		if _, exists := m.names[m.nameStripe(user.Name)].index[user.Name]; exists {
+			return fmt.Errorf("user already exists")
+		}
+		if _, exists := m.parties[user.Party]; exists {
+			return fmt.Errorf("party already exists")
+		}
+	}
+	err := m.commit(walRecord{Op: "add", Users: users})
+	if err != nil {
+		return err
 	}
 
-	bin[user.Name] = user
+	stripe := m.binStripe(idx)
+	stripe.mutex.Lock()
+	defer stripe.mutex.Unlock()
+
+	if _, exists := stripe.bins[idx]; !exists {
+		stripe.bins[idx] = make(map[string]*QueuedUser)
+	}
+
+	for _, user := range users {
+		stripe.bins[idx][user.Name] = user
+		m.names[m.nameStripe(user.Name)].index[user.Name] = idx
+	}
+	for _, user := range users {
+		if user.Party != "" {
+			m.parties[user.Party] = idx
+		}
+	}
 	return nil
 }
 
 func (m *inmemoryUserQueue) GetBin(_ context.Context, idx BinIdx) ([]*QueuedUser, error) {
-	if _, exists := m.bins[idx]; !exists {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	stripe := m.binStripe(idx)
+	stripe.mutex.RLock()
+	defer stripe.mutex.RUnlock()
+
+	if _, exists := stripe.bins[idx]; !exists {
 		return nil, nil
 	}
 
-	bin := m.bins[idx]
+	bin := stripe.bins[idx]
 
 	slice := make([]*QueuedUser, 0, len(bin))
 	for _, user := range bin {
@@ -58,60 +202,439 @@ func (m *inmemoryUserQueue) GetBin(_ context.Context, idx BinIdx) ([]*QueuedUser
 }
 
 func (m *inmemoryUserQueue) GetRect(ctx context.Context, lo BinIdx, hi BinIdx, minWait time.Duration) ([]*QueuedUser, error) {
-	bins := []map[string]*QueuedUser{}
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	// todo: this might not be a great idea
+	// todo: different func calls will have different now-s
+	now := time.Now().UTC()
+
+	// the bins are read one by one, not as a snapshot
+	slice := []*QueuedUser{}
 	for s := lo.S; s <= hi.S; s++ {
 		for l := lo.L; l <= hi.L; l++ {
 			idx := BinIdx{S: s, L: l}
-			if bin, exists := m.bins[idx]; exists {
-				bins = append(bins, bin)
+			stripe := m.binStripe(idx)
+			stripe.mutex.RLock()
+			for _, user := range stripe.bins[idx] {
+				if now.Sub(user.QueuedAt) >= minWait {
+					slice = append(slice, user)
+				}
 			}
+			stripe.mutex.RUnlock()
 		}
 	}
 
-	// todo: this might not be a great idea
-	// todo: different func calls will have different now-s
+	return slice, nil
+}
+
+func (m *inmemoryUserQueue) GetGrid(_ context.Context, minWait time.Duration) (map[BinIdx][]*QueuedUser, error) {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
 	now := time.Now().UTC()
 
-	slice := []*QueuedUser{}
-	for _, bin := range bins {
-		for _, user := range bin {
-			if now.Sub(user.QueuedAt) >= minWait {
-				slice = append(slice, user)
+	// the stripes are read one by one, not as a snapshot
+	grid := make(map[BinIdx][]*QueuedUser)
+	for idx := range m.bins {
+		stripe := &m.bins[idx]
+		stripe.mutex.RLock()
+		for idx, bin := range stripe.bins {
+			for _, user := range bin {
+				if minWait <= 0 || now.Sub(user.QueuedAt) >= minWait {
+					grid[idx] = append(grid[idx], user)
+				}
 			}
 		}
+		stripe.mutex.RUnlock()
 	}
+	return grid, nil
+}
 
-	return slice, nil
+// Occupied costs as much as there are occupied bins, the empty ones are dropped from the stripes
+func (m *inmemoryUserQueue) Occupied(context.Context) (map[BinIdx]int, error) {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	counts := make(map[BinIdx]int)
+	for idx := range m.bins {
+		stripe := &m.bins[idx]
+		stripe.mutex.RLock()
+		for idx, bin := range stripe.bins {
+			counts[idx] = len(bin)
+		}
+		stripe.mutex.RUnlock()
+	}
+	return counts, nil
 }
 
 func (m *inmemoryUserQueue) Remove(_ context.Context, keys []string) error {
-	// ouch
-	for _, bin := range m.bins {
-		for _, key := range keys {
-			delete(bin, key)
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	unlock := m.lockNames(keys)
+	defer unlock()
+
+	queued := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, exists := m.names[m.nameStripe(key)].index[key]; exists {
+			queued = append(queued, key)
+		}
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+	err := m.commit(walRecord{Op: "remove", Names: queued})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range queued {
+		m.remove(key)
+	}
+	return nil
+}
+
+func (m *inmemoryUserQueue) Claim(_ context.Context, names []string) (bool, error) {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	unlock := m.lockNames(names)
+	defer unlock()
+
+	for _, name := range names {
+		if _, exists := m.names[m.nameStripe(name)].index[name]; !exists {
+			return false, nil
+		}
+	}
+	err := m.commit(walRecord{Op: "remove", Names: names})
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		m.remove(name)
+	}
+	return true, nil
+}
+
+func (m *inmemoryUserQueue) Delete(_ context.Context, name string) error {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	_, err := m.drop(name, nil)
+	return err
+}
+
+// drop removes the user along with their party, if the user passes the check (with their name locked).
+// Returns the removed names, or ErrNotQueued
+func (m *inmemoryUserQueue) drop(name string, check func(*QueuedUser) bool) ([]string, error) {
+	// the bins of the users only change with the grid
+	idx, exists := m.lookup(name)
+	if !exists {
+		return nil, ErrNotQueued
+	}
+
+	// the party members share a bin, and a party can't be joined later
+	stripe := m.binStripe(idx)
+	stripe.mutex.RLock()
+	names := []string{name}
+	party := ""
+	if user, exists := stripe.bins[idx][name]; exists && user.Party != "" {
+		party = user.Party
+		for _, other := range stripe.bins[idx] {
+			if other.Party == party && other.Name != name {
+				names = append(names, other.Name)
+			}
+		}
+	}
+	stripe.mutex.RUnlock()
+
+	unlock := m.lockNames(names)
+	defer unlock()
+
+	if check != nil && !m.passes(name, idx, check) {
+		return nil, nil
+	}
+	// removed meanwhile
+	if _, exists := m.names[m.nameStripe(name)].index[name]; !exists {
+		return nil, ErrNotQueued
+	}
+	removed := []string{name}
+	for _, other := range names[1:] {
+		// the name could have been reused meanwhile
+		if m.inParty(other, idx, party) {
+			removed = append(removed, other)
+		}
+	}
+
+	err := m.commit(walRecord{Op: "remove", Names: removed})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range removed {
+		m.remove(name)
+	}
+	return removed, nil
+}
+
+// passes reports whether the user is still in the bin and passes the check, the name stripe must be locked
+func (m *inmemoryUserQueue) passes(name string, idx BinIdx, check func(*QueuedUser) bool) bool {
+	stripe := m.binStripe(idx)
+	stripe.mutex.RLock()
+	defer stripe.mutex.RUnlock()
+
+	user, exists := stripe.bins[idx][name]
+	return exists && check(user)
+}
+
+func (m *inmemoryUserQueue) Heartbeat(_ context.Context, name string) error {
+	return m.heartbeat(name, time.Now().UTC())
+}
+
+// heartbeat marks the user and their party as seen at the time
+func (m *inmemoryUserQueue) heartbeat(name string, at time.Time) error {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	idx, exists := m.lookup(name)
+	if !exists {
+		return ErrNotQueued
+	}
+
+	stripe := m.binStripe(idx)
+	stripe.mutex.Lock()
+	defer stripe.mutex.Unlock()
+
+	bin := stripe.bins[idx]
+	user, exists := bin[name]
+	if !exists {
+		return ErrNotQueued
+	}
+	err := m.commit(walRecord{Op: "heartbeat", Names: []string{name}, At: &at})
+	if err != nil {
+		return err
+	}
+	// the users are shared with the readers, so they are replaced instead of changed
+	for _, other := range bin {
+		if other.Name == name || (user.Party != "" && other.Party == user.Party) {
+			seen := *other
+			seen.SeenAt = at
+			bin[other.Name] = &seen
 		}
 	}
 	return nil
 }
 
+func (m *inmemoryUserQueue) Expire(_ context.Context, before time.Time) ([]string, error) {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	expired := func(user *QueuedUser) bool {
+		return lastSeen(user).Before(before)
+	}
+
+	// the stripes are read one by one, the users are checked again while they are removed
+	candidates := []string{}
+	for idx := range m.bins {
+		stripe := &m.bins[idx]
+		stripe.mutex.RLock()
+		for _, bin := range stripe.bins {
+			for _, user := range bin {
+				if expired(user) {
+					candidates = append(candidates, user.Name)
+				}
+			}
+		}
+		stripe.mutex.RUnlock()
+	}
+
+	removed := []string{}
+	for _, name := range candidates {
+		names, err := m.drop(name, expired)
+		// removed along with their party
+		if errors.Is(err, ErrNotQueued) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, names...)
+	}
+	return removed, nil
+}
+
+// inParty reports whether the user is still a member of the party, the name stripe must be locked
+func (m *inmemoryUserQueue) inParty(name string, idx BinIdx, party string) bool {
+	if m.names[m.nameStripe(name)].index[name] != idx {
+		return false
+	}
+
+	stripe := m.binStripe(idx)
+	stripe.mutex.RLock()
+	defer stripe.mutex.RUnlock()
+
+	user, exists := stripe.bins[idx][name]
+	return exists && user.Party == party
+}
+
+// remove takes the user out, the name stripe must be locked
+func (m *inmemoryUserQueue) remove(name string) bool {
+	names := &m.names[m.nameStripe(name)]
+	idx, exists := names.index[name]
+	if !exists {
+		return false
+	}
+
+	m.partyMutex.Lock()
+	defer m.partyMutex.Unlock()
+
+	stripe := m.binStripe(idx)
+	stripe.mutex.Lock()
+	defer stripe.mutex.Unlock()
+
+	bin := stripe.bins[idx]
+	party := bin[name].Party
+	delete(bin, name)
+	delete(names.index, name)
+
+	if party != "" && !binHasParty(bin, party) {
+		delete(m.parties, party)
+	}
+	if len(bin) == 0 {
+		delete(stripe.bins, idx)
+	}
+	return true
+}
+
+func binHasParty(bin map[string]*QueuedUser, party string) bool {
+	for _, user := range bin {
+		if user.Party == party {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *inmemoryUserQueue) Count(context.Context) (int, error) {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
 	var count int
-	for _, bin := range m.bins {
-		count += len(bin)
+	for idx := range m.names {
+		stripe := &m.names[idx]
+		stripe.mutex.RLock()
+		count += len(stripe.index)
+		stripe.mutex.RUnlock()
 	}
 	return count, nil
 }
 
-func (m *inmemoryUserQueue) toIndex(req *QueuedUser) BinIdx {
-	return BinIdx{
-		S: remap(req.Skill, m.cfg.SkillCeil, m.cfg.Side),
-		L: remap(req.Latency, m.cfg.LatencyCeil, m.cfg.Side),
+// binLen is the number of the users in the bin
+func (m *inmemoryUserQueue) binLen(idx BinIdx) int {
+	stripe := m.binStripe(idx)
+	stripe.mutex.RLock()
+	defer stripe.mutex.RUnlock()
+	return len(stripe.bins[idx])
+}
+
+func (m *inmemoryUserQueue) Status(_ context.Context, name string, radius int) (*UserStatus, error) {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	idx, exists := m.lookup(name)
+	if !exists {
+		return nil, ErrNotQueued
+	}
+
+	stripe := m.binStripe(idx)
+	stripe.mutex.RLock()
+	user, exists := stripe.bins[idx][name]
+	if !exists {
+		// removed meanwhile
+		stripe.mutex.RUnlock()
+		return nil, ErrNotQueued
+	}
+	status := UserStatus{
+		QueuedUser: *user,
+		Bin:        idx,
 	}
+
+	for _, other := range stripe.bins[idx] {
+		if other.Name == name {
+			continue
+		}
+		status.BinCount++
+		if other.QueuedAt.Before(user.QueuedAt) {
+			status.Position++
+		}
+	}
+	stripe.mutex.RUnlock()
+
+	for s := idx.S - radius; s <= idx.S+radius; s++ {
+		for l := idx.L - radius; l <= idx.L+radius; l++ {
+			other := BinIdx{S: s, L: l}
+			if other == idx {
+				continue
+			}
+			status.NeighbourCount += m.binLen(other)
+		}
+	}
+
+	return &status, nil
+}
+
+// all returns every queued user, the grid must be locked for writing, so none of the stripes are locked
+func (m *inmemoryUserQueue) all() []*QueuedUser {
+	users := []*QueuedUser{}
+	for idx := range m.bins {
+		for _, bin := range m.bins[idx].bins {
+			for _, user := range bin {
+				users = append(users, user)
+			}
+		}
+	}
+	return users
+}
+
+// Reconfigure waits for the other operations, none of the stripes are locked meanwhile
+func (m *inmemoryUserQueue) Reconfigure(_ context.Context, cfg GridConfig) error {
+	m.grid.Lock()
+	defer m.grid.Unlock()
+
+	err := m.commit(walRecord{Op: "reconfigure", cfg: &cfg})
+	if err != nil {
+		return err
+	}
+
+	users := m.all()
+	index := rebin(users, &cfg)
+	for idx := range m.bins {
+		m.bins[idx].bins = make(map[BinIdx]map[string]*QueuedUser)
+	}
+	for idx := range m.names {
+		m.names[idx].index = make(map[string]BinIdx)
+	}
+	m.parties = make(map[string]BinIdx)
+
+	for _, user := range users {
+		idx := index[user.Name]
+		stripe := m.binStripe(idx)
+		if _, exists := stripe.bins[idx]; !exists {
+			stripe.bins[idx] = make(map[string]*QueuedUser)
+		}
+		stripe.bins[idx][user.Name] = user
+		m.names[m.nameStripe(user.Name)].index[user.Name] = idx
+		if user.Party != "" {
+			m.parties[user.Party] = idx
+		}
+	}
+
+	m.cfg = cfg
+	return nil
 }
 
-func remap(value float64, ceil float64, sides int) int {
-	// inverse lerp
-	value = value / ceil
+// remap splits the normalized value into the bins
+func remap(value float64, sides int) int {
 	// lerp
 	value = value * float64(sides)
 	// floor
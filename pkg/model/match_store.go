@@ -0,0 +1,21 @@
+package model
+
+import (
+	"context"
+	"errors"
+
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+var ErrNoMatch = errors.New("no such match")
+
+type MatchStore interface {
+	// Add assigns the next serial to the match, then stores it
+	Add(context.Context, *schema.MatchResponse) error
+	// Get returns ErrNoMatch if there is no such match
+	Get(ctx context.Context, serial int) (*schema.MatchResponse, error)
+	// List returns up to limit matches with serials > since, in ascending order
+	List(ctx context.Context, since int, limit int) ([]schema.MatchResponse, error)
+	// ListUser is List over the matches the user was a part of
+	ListUser(ctx context.Context, name string, since int, limit int) ([]schema.MatchResponse, error)
+}
@@ -0,0 +1,195 @@
+package model_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/schema"
+	"github.com/stretchr/testify/require"
+)
+
+var wantMatch = schema.MatchResponse{
+	Queue:       "ranked-8",
+	FormedAt:    now().Truncate(time.Microsecond),
+	Skill:       schema.Candle{Min: 1, Average: 2, Max: 3, Deviation: 0.5},
+	Latency:     schema.Candle{Min: 10, Average: 20, Max: 30, Deviation: 5},
+	WaitSeconds: schema.Candle{Min: 4, Average: 5, Max: 6, Deviation: 1},
+	Names:       []string{"user2", "user0", "user1", "user3"},
+	Teams: []schema.Team{
+		{Names: []string{"user2", "user1"}, Skill: schema.Candle{Min: 1, Average: 2, Max: 3, Deviation: 1}},
+		{Names: []string{"user0", "user3"}, Skill: schema.Candle{Min: 1.5, Average: 2, Max: 2.5, Deviation: 0.5}},
+	},
+	Roles:   map[string]string{"user0": "tank", "user1": "tank", "user2": "healer", "user3": "healer"},
+	Quality: 0.75,
+}
+
+func TestMatchStoreAdd(t *testing.T) {
+	rangeMatchStore(t, func(t *testing.T, factory factoryMatchStore) {
+		require := require.New(t)
+		matches := factory(t)
+
+		first := wantMatch
+		err := matches.Add(ctx, &first)
+		require.Nil(err)
+
+		second := wantMatch
+		err = matches.Add(ctx, &second)
+		require.Nil(err)
+		require.Greater(second.Serial, first.Serial)
+
+		have, err := matches.Get(ctx, first.Serial)
+		require.Nil(err)
+		require.Equal(first.Serial, have.Serial)
+		require.Equal(wantMatch.Queue, have.Queue)
+		require.Equal(wantMatch.Names, have.Names)
+		require.Equal(wantMatch.Skill, have.Skill)
+		require.Equal(wantMatch.Latency, have.Latency)
+		require.Equal(wantMatch.WaitSeconds, have.WaitSeconds)
+		require.Equal(wantMatch.Teams, have.Teams)
+		require.Equal(wantMatch.Roles, have.Roles)
+		require.Equal(wantMatch.Quality, have.Quality)
+		require.True(wantMatch.FormedAt.Equal(have.FormedAt))
+
+		have, err = matches.Get(ctx, second.Serial+1)
+		require.Nil(have)
+		require.ErrorIs(err, model.ErrNoMatch)
+	})
+}
+
+func TestMatchStoreList(t *testing.T) {
+	rangeMatchStore(t, func(t *testing.T, factory factoryMatchStore) {
+		require := require.New(t)
+		matches := factory(t)
+
+		have, err := matches.List(ctx, 0, 10)
+		require.Nil(err)
+		require.Len(have, 0)
+
+		serials := []int{}
+		for idx := range 5 {
+			match := wantMatch
+			match.Names = []string{fmt.Sprintf("user%d", idx), "bob"}
+			err := matches.Add(ctx, &match)
+			require.Nil(err)
+			serials = append(serials, match.Serial)
+		}
+
+		have, err = matches.List(ctx, 0, 3)
+		require.Nil(err)
+		require.Len(have, 3)
+		require.Equal(serials[0], have[0].Serial)
+		require.Equal(serials[2], have[2].Serial)
+
+		have, err = matches.List(ctx, serials[2], 3)
+		require.Nil(err)
+		require.Len(have, 2)
+		require.Equal(serials[3], have[0].Serial)
+		require.Equal([]string{"user4", "bob"}, have[1].Names)
+
+		have, err = matches.ListUser(ctx, "bob", serials[0], 2)
+		require.Nil(err)
+		require.Len(have, 2)
+		require.Equal(serials[1], have[0].Serial)
+		require.Equal(serials[2], have[1].Serial)
+
+		have, err = matches.ListUser(ctx, "user3", 0, 10)
+		require.Nil(err)
+		require.Len(have, 1)
+		require.Equal(serials[3], have[0].Serial)
+
+		have, err = matches.ListUser(ctx, "alice", 0, 10)
+		require.Nil(err)
+		require.Len(have, 0)
+	})
+}
+
+func TestMatchStoreRestart(t *testing.T) {
+	table := []struct {
+		label string
+		open  func(dir string) (model.MatchStore, func())
+	}{
+		{
+			"durable", func(dir string) (model.MatchStore, func()) {
+				matches, err := model.NewMatchStoreDurable(dir)
+				require.Nil(t, err)
+				return matches, func() {}
+			},
+		},
+		{
+			"sqlite", func(dir string) (model.MatchStore, func()) {
+				db, err := model.OpenSqlite(filepath.Join(dir, "matches.db"))
+				require.Nil(t, err)
+				return model.NewMatchStoreSqlite(db), func() { db.Close() }
+			},
+		},
+	}
+	for _, row := range table {
+		t.Run(row.label, func(t *testing.T) {
+			require := require.New(t)
+			dir := t.TempDir()
+
+			matches, closeDb := row.open(dir)
+			first := wantMatch
+			require.Nil(matches.Add(ctx, &first))
+			closeDb()
+
+			// the serials continue after the restart, and the history is kept
+			matches, closeDb = row.open(dir)
+			defer closeDb()
+			second := wantMatch
+			require.Nil(matches.Add(ctx, &second))
+			require.Greater(second.Serial, first.Serial)
+
+			have, err := matches.List(ctx, 0, 10)
+			require.Nil(err)
+			require.Len(have, 2)
+			require.Equal(wantMatch.Names, have[0].Names)
+		})
+	}
+}
+
+type factoryMatchStore func(t *testing.T) model.MatchStore
+
+func rangeMatchStore(t *testing.T, run func(*testing.T, factoryMatchStore)) {
+	table := []struct {
+		label   string
+		factory factoryMatchStore
+	}{
+		{
+			"inmem", func(*testing.T) model.MatchStore {
+				return model.NewMatchStoreInmemory()
+			},
+		},
+		{
+			"durable", func(t *testing.T) model.MatchStore {
+				matches, err := model.NewMatchStoreDurable(t.TempDir())
+				require.Nil(t, err)
+				return matches
+			},
+		},
+		{
+			"postgres", func(*testing.T) model.MatchStore {
+				db, _ := pgxpool.New(context.Background(), dbUrl)
+				db.Exec(context.Background(), `delete from Matches`)
+				// can't `defer db.Close()`
+				return model.NewMatchStorePostgres(db)
+			},
+		},
+		{
+			"sqlite", func(*testing.T) model.MatchStore {
+				db, _ := model.OpenSqlite(":memory:")
+				return model.NewMatchStoreSqlite(db)
+			},
+		},
+	}
+	for _, row := range table {
+		t.Run(row.label, func(t *testing.T) {
+			run(t, row.factory)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// NewElectionPostgres takes a session advisory lock per queue, on a connection of its own.
+// The locks are released by postgres once the connection is gone, ie: the leader has died
+func NewElectionPostgres(db *pgxpool.Pool) Election {
+	return &pgElection{
+		db:   db,
+		held: make(map[string]bool),
+	}
+}
+
+type pgElection struct {
+	db *pgxpool.Pool
+	// a pgx connection is not safe for concurrent use, the queues share it
+	mutex sync.Mutex
+	// nil until the first lead, or after it has broken
+	conn *pgxpool.Conn
+	held map[string]bool // queue -> led
+}
+
+func (e *pgElection) Lead(ctx context.Context, queue string) (bool, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.conn == nil {
+		conn, err := e.db.Acquire(ctx)
+		if err != nil {
+			return false, err
+		}
+		e.conn = conn
+	}
+
+	// the lock is reentrant, it is only checked that the session is still alive
+	if e.held[queue] {
+		err := e.conn.Ping(ctx)
+		if err != nil {
+			e.drop()
+			return false, err
+		}
+		return true, nil
+	}
+
+	row := e.conn.QueryRow(ctx, `select pg_try_advisory_lock(hashtext('matching/' || $1))`, queue)
+	locked := false
+	err := row.Scan(&locked)
+	if err != nil {
+		e.drop()
+		return false, err
+	}
+	e.held[queue] = locked
+	return locked, nil
+}
+
+func (e *pgElection) Resign() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.conn != nil {
+		e.drop()
+	}
+}
+
+// drop closes the connection, so every lock of it is released, and the others may lead meanwhile
+func (e *pgElection) drop() {
+	e.conn.Conn().Close(context.Background())
+	e.conn.Release()
+	e.conn = nil
+	clear(e.held)
+}
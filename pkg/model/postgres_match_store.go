@@ -0,0 +1,168 @@
+package model
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// the columns of a match, in the order of scanMatch
+const matchColumns = `
+	Serial, Queue, FormedAt,
+	SkillMin, SkillAverage, SkillMax, SkillDeviation,
+	LatencyMin, LatencyAverage, LatencyMax, LatencyDeviation,
+	WaitMin, WaitAverage, WaitMax, WaitDeviation,
+	Teams, SkillDelta, Roles, Region, Quality,
+	array(
+		select Name
+		from MatchMembers
+		where MatchMembers.Serial = Matches.Serial
+		order by Position)`
+
+func NewMatchStorePostgres(db *pgxpool.Pool) MatchStore {
+	return &pgMatchStore{
+		db: db,
+	}
+}
+
+// the serials come from an identity column, so they never repeat.
+// The adds take them under a lock, so they are committed in order
+// and a List since a serial never skips over a later commit
+type pgMatchStore struct {
+	db *pgxpool.Pool
+}
+
+func (m *pgMatchStore) Add(ctx context.Context, match *schema.MatchResponse) error {
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// the leaders of the queues add concurrently
+	_, err = tx.Exec(ctx, `select pg_advisory_xact_lock(hashtext('matches'))`)
+	if err != nil {
+		return err
+	}
+
+	row := tx.QueryRow(ctx, `
+		insert into Matches
+			(Queue, FormedAt,
+			SkillMin, SkillAverage, SkillMax, SkillDeviation,
+			LatencyMin, LatencyAverage, LatencyMax, LatencyDeviation,
+			WaitMin, WaitAverage, WaitMax, WaitDeviation,
+			Teams, SkillDelta, Roles, Region, Quality)
+		values
+			($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+		returning Serial`,
+		match.Queue, match.FormedAt,
+		match.Skill.Min, match.Skill.Average, match.Skill.Max, match.Skill.Deviation,
+		match.Latency.Min, match.Latency.Average, match.Latency.Max, match.Latency.Deviation,
+		match.WaitSeconds.Min, match.WaitSeconds.Average, match.WaitSeconds.Max, match.WaitSeconds.Deviation,
+		match.Teams, match.SkillDelta, match.Roles, match.Region, match.Quality)
+
+	serial := 0
+	err = row.Scan(&serial)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		insert into MatchMembers
+			(Serial, Position, Name)
+		select $1, Position, Name
+		from unnest($2::text[]) with ordinality as Members(Name, Position)`,
+		serial, match.Names)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	match.Serial = serial
+	return nil
+}
+
+func (m *pgMatchStore) Get(ctx context.Context, serial int) (*schema.MatchResponse, error) {
+	row := m.db.QueryRow(ctx, `
+		select `+matchColumns+`
+		from Matches
+		where Serial = $1`,
+		serial)
+
+	match, err := scanMatch(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoMatch
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &match, nil
+}
+
+func (m *pgMatchStore) List(ctx context.Context, since int, limit int) ([]schema.MatchResponse, error) {
+	rows, err := m.db.Query(ctx, `
+		select `+matchColumns+`
+		from Matches
+		where Serial > $1
+		order by Serial
+		limit $2`,
+		since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectMatches(rows)
+}
+
+func (m *pgMatchStore) ListUser(ctx context.Context, name string, since int, limit int) ([]schema.MatchResponse, error) {
+	rows, err := m.db.Query(ctx, `
+		select `+matchColumns+`
+		from Matches
+		where Serial in (
+			select Serial
+			from MatchMembers
+			where Name = $1 and Serial > $2)
+		order by Serial
+		limit $3`,
+		name, since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectMatches(rows)
+}
+
+func collectMatches(rows pgx.Rows) ([]schema.MatchResponse, error) {
+	defer rows.Close()
+
+	matches := []schema.MatchResponse{}
+	for rows.Next() {
+		match, err := scanMatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+
+	return matches, rows.Err()
+}
+
+func scanMatch(row pgx.Row) (schema.MatchResponse, error) {
+	match := schema.MatchResponse{}
+	err := row.Scan(
+		&match.Serial, &match.Queue, &match.FormedAt,
+		&match.Skill.Min, &match.Skill.Average, &match.Skill.Max, &match.Skill.Deviation,
+		&match.Latency.Min, &match.Latency.Average, &match.Latency.Max, &match.Latency.Deviation,
+		&match.WaitSeconds.Min, &match.WaitSeconds.Average, &match.WaitSeconds.Max, &match.WaitSeconds.Deviation,
+		&match.Teams, &match.SkillDelta, &match.Roles, &match.Region, &match.Quality,
+		&match.Names)
+	return match, err
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func NewSettingsStorePostgres(db *pgxpool.Pool) SettingsStore {
+	return &pgSettingsStore{
+		db: db,
+	}
+}
+
+// a row per queue, shared by the instances
+type pgSettingsStore struct {
+	db *pgxpool.Pool
+}
+
+func (m *pgSettingsStore) Load(ctx context.Context, queue string) (map[string]string, error) {
+	row := m.db.QueryRow(ctx, `
+		select Settings
+		from QueueSettings
+		where Queue = $1`,
+		queue)
+
+	var settings map[string]string
+	err := row.Scan(&settings)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (m *pgSettingsStore) Save(ctx context.Context, queue string, settings map[string]string) error {
+	_, err := m.db.Exec(ctx, `
+		insert into QueueSettings (Queue, Settings)
+		values ($1, $2)
+		on conflict (Queue) do update
+		set Settings = excluded.Settings`,
+		queue, settings)
+	return err
+}
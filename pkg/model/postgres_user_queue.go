@@ -2,35 +2,102 @@ package model
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/starnuik/golang_match/pkg/schema"
 )
 
-func NewUserQueuePostgres(cfg GridConfig, db *pgxpool.Pool) UserQueue {
+// the queues share the table, each one only sees its own rows
+func NewUserQueuePostgres(cfg GridConfig, db *pgxpool.Pool, queue string) UserQueue {
 	return &pgUserQueue{
 		GridConfig: cfg,
 		db:         db,
+		queue:      queue,
 	}
 }
 
 type pgUserQueue struct {
 	GridConfig
-	db *pgxpool.Pool
+	// held for reading while the users are placed, and for writing while they are moved
+	grid  sync.RWMutex
+	db    *pgxpool.Pool
+	queue string
 }
 
 // Add implements UserQueue.
 func (m *pgUserQueue) Add(ctx context.Context, user *QueuedUser) error {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	m.observe([]*QueuedUser{user})
 	idx := toIndex(user, &m.GridConfig)
+	return m.insert(ctx, m.db, user, idx)
+}
 
-	tag, err := m.db.Exec(ctx, `
+func (m *pgUserQueue) AddParty(ctx context.Context, members []*QueuedUser) error {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	m.observe(members)
+	idx := partyIndex(members, &m.GridConfig)
+
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// nothing in the schema keeps a party unique, so the adds of the same party
+	// queue on a lock that lives until the end of the transaction
+	_, err = tx.Exec(ctx, `select pg_advisory_xact_lock(hashtext('party/' || $1 || '/' || $2))`, m.queue, members[0].Party)
+	if err != nil {
+		return err
+	}
+
+	row := tx.QueryRow(ctx, `
+		select exists (
+			select 1
+			from UserQueue
+			where Queue = $1 and Party = $2)`,
+		m.queue, members[0].Party)
+	exists := false
+	err = row.Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("party already exists")
+	}
+
+	for _, user := range members {
+		err := m.insert(ctx, tx, user, idx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// the common part of a pool and a transaction
+type pgExecutor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+func (m *pgUserQueue) insert(ctx context.Context, db pgExecutor, user *QueuedUser, idx BinIdx) error {
+	tag, err := db.Exec(ctx, `
 		insert into UserQueue
-			(Name, Skill, Latency, QueuedAt, PosS, PosL)
+			(Queue, Name, Skill, Latency, QueuedAt, SeenAt, PosS, PosL, Party, Roles, Latencies)
 		values
-			($1, $2, $3, $4, $5, $6)`,
-		user.Name, user.Skill, user.Latency, user.QueuedAt, idx.S, idx.L)
+			($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		m.queue, user.Name, user.Skill, user.Latency, user.QueuedAt, lastSeen(user), idx.S, idx.L, user.Party, roleArray(user.Roles), user.Latencies)
 
 	if err != nil {
 		return err
@@ -45,12 +112,20 @@ func (m *pgUserQueue) Add(ctx context.Context, user *QueuedUser) error {
 	return nil
 }
 
+// roleArray keeps the column not null, pgx encodes a nil slice as null
+func roleArray(roles []string) []string {
+	if roles == nil {
+		return []string{}
+	}
+	return roles
+}
+
 func (m *pgUserQueue) GetBin(ctx context.Context, idx BinIdx) ([]*QueuedUser, error) {
 	rows, err := m.db.Query(ctx, `
-		select Name, Skill, Latency, QueuedAt
+		select Name, Skill, Latency, QueuedAt, SeenAt, Party, Roles, Latencies
 		from UserQueue
-		where PosS = $1 and PosL = $2`,
-		idx.S, idx.L)
+		where Queue = $1 and PosS = $2 and PosL = $3`,
+		m.queue, idx.S, idx.L)
 	if err != nil {
 		return nil, err
 	}
@@ -59,7 +134,7 @@ func (m *pgUserQueue) GetBin(ctx context.Context, idx BinIdx) ([]*QueuedUser, er
 	bin := []*QueuedUser{}
 	for rows.Next() {
 		user := QueuedUser{}
-		err := rows.Scan(&user.Name, &user.Skill, &user.Latency, &user.QueuedAt)
+		err := rows.Scan(&user.Name, &user.Skill, &user.Latency, &user.QueuedAt, &user.SeenAt, &user.Party, &user.Roles, &user.Latencies)
 		if err != nil {
 			return nil, err
 		}
@@ -76,13 +151,14 @@ func (m *pgUserQueue) GetRect(ctx context.Context, lo BinIdx, hi BinIdx, minWait
 	before := now.Add(-minWait)
 
 	rows, err := m.db.Query(ctx, `
-		select Name, Skill, Latency, QueuedAt
+		select Name, Skill, Latency, QueuedAt, SeenAt, Party, Roles, Latencies
 		from UserQueue
 		where
-			PosS >= $1 and PosL >= $2 and
-			PosS <= $3 and PosL <= $4 and
-			QueuedAt < $5`,
-		lo.S, lo.L, hi.S, hi.L, before)
+			Queue = $1 and
+			PosS >= $2 and PosL >= $3 and
+			PosS <= $4 and PosL <= $5 and
+			QueuedAt < $6`,
+		m.queue, lo.S, lo.L, hi.S, hi.L, before)
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +167,7 @@ func (m *pgUserQueue) GetRect(ctx context.Context, lo BinIdx, hi BinIdx, minWait
 	bin := []*QueuedUser{}
 	for rows.Next() {
 		user := QueuedUser{}
-		err := rows.Scan(&user.Name, &user.Skill, &user.Latency, &user.QueuedAt)
+		err := rows.Scan(&user.Name, &user.Skill, &user.Latency, &user.QueuedAt, &user.SeenAt, &user.Party, &user.Roles, &user.Latencies)
 		if err != nil {
 			return nil, err
 		}
@@ -101,12 +177,71 @@ func (m *pgUserQueue) GetRect(ctx context.Context, lo BinIdx, hi BinIdx, minWait
 	return bin, nil
 }
 
+func (m *pgUserQueue) GetGrid(ctx context.Context, minWait time.Duration) (map[BinIdx][]*QueuedUser, error) {
+	// without a wait, the users queued by the instances with a clock ahead are not skipped
+	before := time.Now().UTC().Add(-minWait)
+	if minWait <= 0 {
+		before = time.Now().UTC().Add(24 * time.Hour)
+	}
+
+	rows, err := m.db.Query(ctx, `
+		select Name, Skill, Latency, QueuedAt, SeenAt, Party, Roles, Latencies, PosS, PosL
+		from UserQueue
+		where Queue = $1 and QueuedAt < $2`,
+		m.queue, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grid := make(map[BinIdx][]*QueuedUser)
+	for rows.Next() {
+		user := QueuedUser{}
+		idx := BinIdx{}
+		err := rows.Scan(&user.Name, &user.Skill, &user.Latency, &user.QueuedAt, &user.SeenAt, &user.Party, &user.Roles, &user.Latencies, &idx.S, &idx.L)
+		if err != nil {
+			return nil, err
+		}
+		grid[idx] = append(grid[idx], &user)
+	}
+
+	return grid, rows.Err()
+}
+
+// Occupied can be an index only scan of UserQueue_Pos (Queue, PosS, PosL), see the migration 00009,
+// so it stays cheap even when the kernels poll it every tick
+func (m *pgUserQueue) Occupied(ctx context.Context) (map[BinIdx]int, error) {
+	rows, err := m.db.Query(ctx, `
+		select PosS, PosL, count(*)
+		from UserQueue
+		where Queue = $1
+		group by PosS, PosL`,
+		m.queue)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[BinIdx]int)
+	for rows.Next() {
+		idx := BinIdx{}
+		count := 0
+		err := rows.Scan(&idx.S, &idx.L, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[idx] = count
+	}
+
+	return counts, rows.Err()
+}
+
 func (m *pgUserQueue) Remove(ctx context.Context, users []string) error {
 	// https://github.com/jackc/pgx/issues/108#issuecomment-160804629
 	tag, err := m.db.Exec(ctx, `
 		delete from UserQueue
-		where Name = any ($1)`,
-		users)
+		where Queue = $1 and Name = any ($2)`,
+		m.queue, users)
 	if err != nil {
 		return err
 	}
@@ -119,10 +254,122 @@ func (m *pgUserQueue) Remove(ctx context.Context, users []string) error {
 	return nil
 }
 
+// Claim locks the rows before deleting them, the rows locked by another claim or a cancel are skipped,
+// so the users can't end up in two matches, even across the instances
+func (m *pgUserQueue) Claim(ctx context.Context, users []string) (bool, error) {
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, `
+		with claimed as (
+			select Name
+			from UserQueue
+			where Queue = $1 and Name = any ($2)
+			for update skip locked)
+		select count(*)
+		from claimed`,
+		m.queue, users)
+	count := 0
+	err = row.Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count != len(users) {
+		return false, nil
+	}
+
+	_, err = tx.Exec(ctx, `
+		delete from UserQueue
+		where Queue = $1 and Name = any ($2)`,
+		m.queue, users)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+func (m *pgUserQueue) Delete(ctx context.Context, name string) error {
+	tag, err := m.db.Exec(ctx, `
+		delete from UserQueue
+		where
+			Queue = $1 and (
+				Name = $2 or
+				Party in (
+					select Party
+					from UserQueue
+					where Queue = $1 and Name = $2 and Party <> ''))`,
+		m.queue, name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotQueued
+	}
+	return nil
+}
+
+func (m *pgUserQueue) Heartbeat(ctx context.Context, name string) error {
+	tag, err := m.db.Exec(ctx, `
+		update UserQueue
+		set SeenAt = $3
+		where
+			Queue = $1 and (
+				Name = $2 or
+				Party in (
+					select Party
+					from UserQueue
+					where Queue = $1 and Name = $2 and Party <> ''))`,
+		m.queue, name, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotQueued
+	}
+	return nil
+}
+
+// Expire is a single statement, the rows locked by a claim are waited for, then skipped if they are gone
+func (m *pgUserQueue) Expire(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := m.db.Query(ctx, `
+		delete from UserQueue
+		where
+			Queue = $1 and (
+				SeenAt < $2 or
+				Party in (
+					select Party
+					from UserQueue
+					where Queue = $1 and SeenAt < $2 and Party <> ''))
+		returning Name`,
+		m.queue, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		name := ""
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
 func (m *pgUserQueue) Count(ctx context.Context) (int, error) {
 	row := m.db.QueryRow(ctx, `
 		select count(*)
-		from UserQueue`)
+		from UserQueue
+		where Queue = $1`,
+		m.queue)
 
 	count := 0
 	err := row.Scan(&count)
@@ -133,6 +380,111 @@ func (m *pgUserQueue) Count(ctx context.Context) (int, error) {
 	return count, nil
 }
 
+func (m *pgUserQueue) Status(ctx context.Context, name string, radius int) (*UserStatus, error) {
+	status := UserStatus{}
+	user := &status.QueuedUser
+	idx := &status.Bin
+
+	row := m.db.QueryRow(ctx, `
+		select Name, Skill, Latency, QueuedAt, SeenAt, Party, Roles, Latencies, PosS, PosL
+		from UserQueue
+		where Queue = $1 and Name = $2`,
+		m.queue, name)
+	err := row.Scan(&user.Name, &user.Skill, &user.Latency, &user.QueuedAt, &user.SeenAt, &user.Party, &user.Roles, &user.Latencies, &idx.S, &idx.L)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotQueued
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	row = m.db.QueryRow(ctx, `
+		select
+			count(*) filter (where PosS = $1 and PosL = $2 and QueuedAt < $4),
+			count(*) filter (where PosS = $1 and PosL = $2),
+			count(*) filter (where PosS <> $1 or PosL <> $2)
+		from UserQueue
+		where
+			Queue = $6 and Name <> $5 and
+			PosS >= $1 - $3 and PosL >= $2 - $3 and
+			PosS <= $1 + $3 and PosL <= $2 + $3`,
+		idx.S, idx.L, radius, user.QueuedAt, user.Name, m.queue)
+	err = row.Scan(&status.Position, &status.BinCount, &status.NeighbourCount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// Reconfigure moves the users in a single transaction, the queue is not written to meanwhile
+func (m *pgUserQueue) Reconfigure(ctx context.Context, cfg GridConfig) error {
+	m.grid.Lock()
+	defer m.grid.Unlock()
+
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		select Name, Skill, Latency, QueuedAt, SeenAt, Party, Roles, Latencies
+		from UserQueue
+		where Queue = $1
+		for update`,
+		m.queue)
+	if err != nil {
+		return err
+	}
+
+	users := []*QueuedUser{}
+	for rows.Next() {
+		user := QueuedUser{}
+		err := rows.Scan(&user.Name, &user.Skill, &user.Latency, &user.QueuedAt, &user.SeenAt, &user.Party, &user.Roles, &user.Latencies)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, &user)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	bins := rebin(users, &cfg)
+	names := make([]string, 0, len(bins))
+	posS := make([]int, 0, len(bins))
+	posL := make([]int, 0, len(bins))
+	for name, idx := range bins {
+		names = append(names, name)
+		posS = append(posS, idx.S)
+		posL = append(posL, idx.L)
+	}
+
+	_, err = tx.Exec(ctx, `
+		update UserQueue
+		set PosS = moved.PosS, PosL = moved.PosL
+		from unnest($2::text[], $3::int[], $4::int[]) as moved (Name, PosS, PosL)
+		where UserQueue.Queue = $1 and UserQueue.Name = moved.Name`,
+		m.queue, names, posS, posL)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	m.GridConfig = cfg
+	return nil
+}
+
 func (m *pgUserQueue) Parse(req *schema.QueueUserRequest) (*QueuedUser, error) {
 	return parse(req)
 }
+
+func (m *pgUserQueue) ParseParty(req *schema.QueuePartyRequest) ([]*QueuedUser, error) {
+	return parseParty(req)
+}
@@ -0,0 +1,319 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// RegionalQueue keeps a grid per region, where the users are placed by their latency to the region.
+// The main grid places them by their lowest latency, and serves the rest of UserQueue
+type RegionalQueue interface {
+	UserQueue
+	// sorted
+	Regions() []string
+	// Region returns nil if there is no such region
+	Region(string) UserQueue
+}
+
+// NewUserQueueRegional wraps the main queue and a queue per region, made by newRegion.
+// Every region is on its own copy of the grid config (see GridConfig.Clone), as the latencies differ by the region.
+// The changes are not atomic across the queues
+func NewUserQueueRegional(cfg GridConfig, main UserQueue, names []string, newRegion func(GridConfig, string) UserQueue) RegionalQueue {
+	names = slices.Clone(names)
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	grids := make(map[string]GridConfig, len(names))
+	regions := make(map[string]UserQueue, len(names))
+	for _, name := range names {
+		grids[name] = cfg.Clone()
+		regions[name] = newRegion(grids[name], name)
+	}
+
+	return &regionalUserQueue{
+		grid:    cfg,
+		grids:   grids,
+		main:    main,
+		names:   names,
+		regions: regions,
+	}
+}
+
+type regionalUserQueue struct {
+	// of the main queue and of every region, changed by Reconfigure only
+	grid    GridConfig
+	grids   map[string]GridConfig
+	main    UserQueue
+	names   []string
+	regions map[string]UserQueue
+}
+
+func (m *regionalUserQueue) Regions() []string {
+	return m.names
+}
+
+func (m *regionalUserQueue) Region(name string) UserQueue {
+	return m.regions[name]
+}
+
+func (m *regionalUserQueue) Parse(req *schema.QueueUserRequest) (*QueuedUser, error) {
+	user, err := m.main.Parse(req)
+	if err != nil {
+		return nil, err
+	}
+	return user, m.checkLatencies(user)
+}
+
+func (m *regionalUserQueue) ParseParty(req *schema.QueuePartyRequest) ([]*QueuedUser, error) {
+	members, err := m.main.ParseParty(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range members {
+		err := m.checkLatencies(user)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(m.partyRegions(members)) == 0 {
+		return nil, fmt.Errorf("no region is shared by the party")
+	}
+	return members, nil
+}
+
+func (m *regionalUserQueue) checkLatencies(user *QueuedUser) error {
+	if len(user.Latencies) == 0 {
+		return fmt.Errorf("no latencies to the regions")
+	}
+	for region := range user.Latencies {
+		if _, exists := m.regions[region]; !exists {
+			return fmt.Errorf("unknown region %s", region)
+		}
+	}
+	return nil
+}
+
+func (m *regionalUserQueue) Add(ctx context.Context, user *QueuedUser) error {
+	err := m.main.Add(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	added := []string{}
+	for _, region := range m.names {
+		latency, exists := user.Latencies[region]
+		if !exists {
+			continue
+		}
+		err := m.regions[region].Add(ctx, atRegion(user, latency))
+		if err != nil {
+			m.rollbackAdd(ctx, added, []string{user.Name})
+			return err
+		}
+		added = append(added, region)
+	}
+	return nil
+}
+
+func (m *regionalUserQueue) AddParty(ctx context.Context, members []*QueuedUser) error {
+	err := m.main.AddParty(ctx, members)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(members))
+	for _, user := range members {
+		names = append(names, user.Name)
+	}
+
+	added := []string{}
+	for _, region := range m.partyRegions(members) {
+		regional := make([]*QueuedUser, 0, len(members))
+		for _, user := range members {
+			regional = append(regional, atRegion(user, user.Latencies[region]))
+		}
+
+		err := m.regions[region].AddParty(ctx, regional)
+		if err != nil {
+			m.rollbackAdd(ctx, added, names)
+			return err
+		}
+		added = append(added, region)
+	}
+	return nil
+}
+
+// rollbackAdd removes the users from the main queue and the regions they were added to,
+// so a failed add leaves nobody queued halfway
+func (m *regionalUserQueue) rollbackAdd(ctx context.Context, regions []string, users []string) {
+	for _, region := range regions {
+		err := m.regions[region].Remove(ctx, users)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	err := m.main.Remove(ctx, users)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// partyRegions returns the regions every member has a latency to
+func (m *regionalUserQueue) partyRegions(members []*QueuedUser) []string {
+	shared := []string{}
+	for _, region := range m.names {
+		everyone := true
+		for _, user := range members {
+			if _, exists := user.Latencies[region]; !exists {
+				everyone = false
+				break
+			}
+		}
+		if everyone {
+			shared = append(shared, region)
+		}
+	}
+	return shared
+}
+
+func (m *regionalUserQueue) GetBin(ctx context.Context, idx BinIdx) ([]*QueuedUser, error) {
+	return m.main.GetBin(ctx, idx)
+}
+
+func (m *regionalUserQueue) GetRect(ctx context.Context, lo BinIdx, hi BinIdx, minWait time.Duration) ([]*QueuedUser, error) {
+	return m.main.GetRect(ctx, lo, hi, minWait)
+}
+
+func (m *regionalUserQueue) GetGrid(ctx context.Context, minWait time.Duration) (map[BinIdx][]*QueuedUser, error) {
+	return m.main.GetGrid(ctx, minWait)
+}
+
+func (m *regionalUserQueue) Occupied(ctx context.Context) (map[BinIdx]int, error) {
+	return m.main.Occupied(ctx)
+}
+
+func (m *regionalUserQueue) Remove(ctx context.Context, users []string) error {
+	err := m.main.Remove(ctx, users)
+	if err != nil {
+		return err
+	}
+
+	for _, region := range m.names {
+		err := m.regions[region].Remove(ctx, users)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Claim is decided by the main queue, the users are then removed from the regions.
+// The users left over in a region after an error can't be claimed again anyway
+func (m *regionalUserQueue) Claim(ctx context.Context, users []string) (bool, error) {
+	claimed, err := m.main.Claim(ctx, users)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	for _, region := range m.names {
+		err := m.regions[region].Remove(ctx, users)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return true, nil
+}
+
+func (m *regionalUserQueue) Delete(ctx context.Context, name string) error {
+	err := m.main.Delete(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for _, region := range m.names {
+		err := m.regions[region].Delete(ctx, name)
+		// the user has no latency to this region
+		if errors.Is(err, ErrNotQueued) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Heartbeat only marks the main queue, the regions are expired along with it
+func (m *regionalUserQueue) Heartbeat(ctx context.Context, name string) error {
+	return m.main.Heartbeat(ctx, name)
+}
+
+func (m *regionalUserQueue) Expire(ctx context.Context, before time.Time) ([]string, error) {
+	names, err := m.main.Expire(ctx, before)
+	if err != nil || len(names) == 0 {
+		return names, err
+	}
+
+	for _, region := range m.names {
+		err := m.regions[region].Remove(ctx, names)
+		if err != nil {
+			return names, err
+		}
+	}
+	return names, nil
+}
+
+func (m *regionalUserQueue) Count(ctx context.Context) (int, error) {
+	return m.main.Count(ctx)
+}
+
+func (m *regionalUserQueue) Status(ctx context.Context, name string, radius int) (*UserStatus, error) {
+	return m.main.Status(ctx, name, radius)
+}
+
+// Reconfigure moves the users of every region too, each region gets its own copy of the config.
+// If a queue fails, the ones moved before it are moved back to their previous grids
+func (m *regionalUserQueue) Reconfigure(ctx context.Context, cfg GridConfig) error {
+	err := m.main.Reconfigure(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	grids := make(map[string]GridConfig, len(m.names))
+	for idx, region := range m.names {
+		grids[region] = cfg.Clone()
+		err := m.regions[region].Reconfigure(ctx, grids[region])
+		if err == nil {
+			continue
+		}
+
+		for _, moved := range m.names[:idx] {
+			rollbackErr := m.regions[moved].Reconfigure(ctx, m.grids[moved])
+			if rollbackErr != nil {
+				log.Println(rollbackErr)
+			}
+		}
+		rollbackErr := m.main.Reconfigure(ctx, m.grid)
+		if rollbackErr != nil {
+			log.Println(rollbackErr)
+		}
+		return err
+	}
+
+	m.grid = cfg
+	m.grids = grids
+	return nil
+}
+
+// atRegion copies the user, with the latency to the region
+func atRegion(user *QueuedUser, latency float64) *QueuedUser {
+	regional := *user
+	regional.Latency = latency
+	return &regional
+}
@@ -0,0 +1,253 @@
+package model_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionalQueue(t *testing.T) {
+	require := require.New(t)
+	users := model.NewUserQueueRegional(cfg, model.NewUserQueueInmemory(cfg), []string{"us", "eu"}, func(grid model.GridConfig, _ string) model.UserQueue {
+		return model.NewUserQueueInmemory(grid)
+	})
+	require.Equal([]string{"eu", "us"}, users.Regions())
+	require.Nil(users.Region("asia"))
+
+	req := schema.QueueUserRequest{
+		Name:      "bob",
+		Skill:     2.5,
+		Latencies: map[string]float64{"eu": 7.5, "us": 2.5},
+	}
+	bob, err := users.Parse(&req)
+	require.Nil(err)
+	// the lowest one
+	require.Equal(2.5, bob.Latency)
+
+	invalid := req
+	invalid.Latencies = map[string]float64{"asia": 2.5}
+	_, err = users.Parse(&invalid)
+	require.Error(err)
+
+	invalid = req
+	invalid.Latencies = nil
+	invalid.Latency = 2.5
+	_, err = users.Parse(&invalid)
+	require.Error(err)
+
+	require.Nil(users.Add(ctx, bob))
+
+	// placed by the latency to every region
+	bin, err := users.Region("eu").GetBin(ctx, model.BinIdx{0, 1})
+	require.Nil(err)
+	require.Len(bin, 1)
+	require.Equal(7.5, bin[0].Latency)
+
+	bin, err = users.Region("us").GetBin(ctx, model.BinIdx{0, 0})
+	require.Nil(err)
+	require.Len(bin, 1)
+
+	bin, err = users.GetBin(ctx, model.BinIdx{0, 0})
+	require.Nil(err)
+	require.Len(bin, 1)
+
+	// a party is only queued in the regions shared by everyone
+	party, err := users.ParseParty(&schema.QueuePartyRequest{
+		Name: "party0",
+		Members: []schema.QueueUserRequest{
+			{Name: "member0", Skill: 2.5, Latencies: map[string]float64{"eu": 2.5, "us": 2.5}},
+			{Name: "member1", Skill: 2.5, Latencies: map[string]float64{"eu": 2.5}},
+		},
+	})
+	require.Nil(err)
+	require.Nil(users.AddParty(ctx, party))
+
+	count, err := users.Region("us").Count(ctx)
+	require.Nil(err)
+	require.Equal(1, count)
+	count, err = users.Region("eu").Count(ctx)
+	require.Nil(err)
+	require.Equal(3, count)
+
+	_, err = users.ParseParty(&schema.QueuePartyRequest{
+		Name: "party1",
+		Members: []schema.QueueUserRequest{
+			{Name: "member2", Skill: 2.5, Latencies: map[string]float64{"eu": 2.5}},
+			{Name: "member3", Skill: 2.5, Latencies: map[string]float64{"us": 2.5}},
+		},
+	})
+	require.Error(err)
+
+	// leaving and getting matched apply to every region
+	require.Nil(users.Delete(ctx, "member1"))
+	require.Nil(users.Remove(ctx, []string{"bob"}))
+	for _, region := range users.Regions() {
+		count, err := users.Region(region).Count(ctx)
+		require.Nil(err)
+		require.Zero(count)
+	}
+
+	err = users.Delete(ctx, "bob")
+	require.ErrorIs(err, model.ErrNotQueued)
+
+	// so does claiming
+	require.Nil(users.Add(ctx, bob))
+	claimed, err := users.Claim(ctx, []string{"bob"})
+	require.Nil(err)
+	require.True(claimed)
+	for _, region := range users.Regions() {
+		count, err := users.Region(region).Count(ctx)
+		require.Nil(err)
+		require.Zero(count)
+	}
+
+	// and expiring, by the heartbeats to the main queue
+	require.Nil(users.Add(ctx, bob))
+	require.Nil(users.Heartbeat(ctx, "bob"))
+	expired, err := users.Expire(ctx, bob.QueuedAt)
+	require.Nil(err)
+	require.Empty(expired)
+	expired, err = users.Expire(ctx, time.Now().UTC().Add(time.Second))
+	require.Nil(err)
+	require.Equal([]string{"bob"}, expired)
+	for _, region := range users.Regions() {
+		count, err := users.Region(region).Count(ctx)
+		require.Nil(err)
+		require.Zero(count)
+	}
+}
+
+// fails every Reconfigure, Add and AddParty
+type brokenQueue struct {
+	model.UserQueue
+}
+
+func (brokenQueue) Reconfigure(context.Context, model.GridConfig) error {
+	return errors.New("broken")
+}
+
+func (brokenQueue) Add(context.Context, *model.QueuedUser) error {
+	return errors.New("broken")
+}
+
+func (brokenQueue) AddParty(context.Context, []*model.QueuedUser) error {
+	return errors.New("broken")
+}
+
+func TestRegionalQueueReconfigureRollback(t *testing.T) {
+	require := require.New(t)
+	users := model.NewUserQueueRegional(cfg, model.NewUserQueueInmemory(cfg), []string{"eu", "us"}, func(grid model.GridConfig, region string) model.UserQueue {
+		if region == "us" {
+			return brokenQueue{model.NewUserQueueInmemory(grid)}
+		}
+		return model.NewUserQueueInmemory(grid)
+	})
+
+	bob := &model.QueuedUser{
+		Name:      "bob",
+		Skill:     2.5,
+		Latency:   2.5,
+		QueuedAt:  now(),
+		Latencies: map[string]float64{"eu": 2.5},
+	}
+	require.Nil(users.Add(ctx, bob))
+
+	finer := model.GridConfig{
+		SkillCeil:   10,
+		LatencyCeil: 10,
+		Side:        4,
+	}
+	require.Error(users.Reconfigure(ctx, finer))
+
+	// the main queue and eu were moved, then moved back
+	for _, queue := range []model.UserQueue{users, users.Region("eu")} {
+		bin, err := queue.GetBin(ctx, model.BinIdx{0, 0})
+		require.Nil(err)
+		require.Len(bin, 1)
+		bin, err = queue.GetBin(ctx, model.BinIdx{1, 1})
+		require.Nil(err)
+		require.Len(bin, 0)
+	}
+}
+
+func TestRegionalQueueAddRollback(t *testing.T) {
+	require := require.New(t)
+	users := model.NewUserQueueRegional(cfg, model.NewUserQueueInmemory(cfg), []string{"eu", "us"}, func(grid model.GridConfig, region string) model.UserQueue {
+		if region == "us" {
+			return brokenQueue{model.NewUserQueueInmemory(grid)}
+		}
+		return model.NewUserQueueInmemory(grid)
+	})
+
+	// added to the main queue and eu, then us fails
+	require.Error(users.Add(ctx, &model.QueuedUser{
+		Name:      "bob",
+		Skill:     2.5,
+		Latency:   2.5,
+		QueuedAt:  now(),
+		Latencies: map[string]float64{"eu": 2.5, "us": 2.5},
+	}))
+	require.Error(users.AddParty(ctx, []*model.QueuedUser{
+		{Name: "member0", Skill: 2.5, Latency: 2.5, QueuedAt: now(), Party: "party0", Latencies: map[string]float64{"eu": 2.5, "us": 2.5}},
+		{Name: "member1", Skill: 2.5, Latency: 2.5, QueuedAt: now(), Party: "party0", Latencies: map[string]float64{"eu": 2.5, "us": 2.5}},
+	}))
+
+	// nobody is left queued halfway
+	for _, queue := range []model.UserQueue{users, users.Region("eu")} {
+		count, err := queue.Count(ctx)
+		require.Nil(err)
+		require.Zero(count)
+	}
+	// and can queue again, once the regions are fine
+	require.Nil(users.Add(ctx, &model.QueuedUser{
+		Name:      "bob",
+		Skill:     2.5,
+		Latency:   2.5,
+		QueuedAt:  now(),
+		Latencies: map[string]float64{"eu": 2.5},
+	}))
+}
+
+func TestRegionalQueueOwnAxes(t *testing.T) {
+	require := require.New(t)
+	quantile := model.GridConfig{
+		SkillCeil:   10_000,
+		LatencyCeil: 10_000,
+		Side:        4,
+		LatencyAxis: model.NewQuantileAxis(),
+	}
+	users := model.NewUserQueueRegional(quantile, model.NewUserQueueInmemory(quantile), []string{"eu", "us"}, func(grid model.GridConfig, _ string) model.UserQueue {
+		return model.NewUserQueueInmemory(grid)
+	})
+
+	// everyone is close to eu and far from us
+	for idx := range 100 {
+		require.Nil(users.Add(ctx, &model.QueuedUser{
+			Name:      fmt.Sprintf("user%d", idx),
+			Latency:   float64(idx),
+			QueuedAt:  now(),
+			Latencies: map[string]float64{"eu": float64(idx), "us": 1000 + float64(idx)},
+		}))
+	}
+	require.Nil(users.Add(ctx, &model.QueuedUser{
+		Name:      "last",
+		Latency:   50,
+		QueuedAt:  now(),
+		Latencies: map[string]float64{"eu": 50, "us": 1000.5},
+	}))
+
+	// the lowest latency to us, among the latencies to us only
+	status, err := users.Region("us").Status(ctx, "last", 0)
+	require.Nil(err)
+	require.Equal(0, status.Bin.L)
+	// the median latency to eu
+	status, err = users.Region("eu").Status(ctx, "last", 0)
+	require.Nil(err)
+	require.Equal(2, status.Bin.L)
+}
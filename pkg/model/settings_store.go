@@ -0,0 +1,43 @@
+package model
+
+import (
+	"context"
+	"maps"
+	"sync"
+)
+
+// SettingsStore keeps the settings the queues have been reconfigured with at runtime,
+// so they outlive a restart and reach the other instances
+type SettingsStore interface {
+	// Load returns nil if the queue has never been reconfigured
+	Load(ctx context.Context, queue string) (map[string]string, error)
+	// Save replaces the settings of the queue
+	Save(ctx context.Context, queue string, settings map[string]string) error
+}
+
+func NewSettingsStoreInmemory() SettingsStore {
+	return &inmemorySettingsStore{
+		queues: make(map[string]map[string]string),
+	}
+}
+
+// the settings are forgotten along with the service
+type inmemorySettingsStore struct {
+	mu     sync.Mutex
+	queues map[string]map[string]string
+}
+
+func (m *inmemorySettingsStore) Load(_ context.Context, queue string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return maps.Clone(m.queues[queue]), nil
+}
+
+func (m *inmemorySettingsStore) Save(_ context.Context, queue string, settings map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queues[queue] = maps.Clone(settings)
+	return nil
+}
@@ -0,0 +1,106 @@
+package model_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettingsStore(t *testing.T) {
+	table := []struct {
+		label   string
+		factory func(t *testing.T) model.SettingsStore
+	}{
+		{
+			"inmem", func(*testing.T) model.SettingsStore {
+				return model.NewSettingsStoreInmemory()
+			},
+		},
+		{
+			"durable", func(t *testing.T) model.SettingsStore {
+				settings, err := model.NewSettingsStoreDurable(t.TempDir())
+				require.Nil(t, err)
+				return settings
+			},
+		},
+		{
+			"postgres", func(*testing.T) model.SettingsStore {
+				db, _ := pgxpool.New(context.Background(), dbUrl)
+				db.Exec(context.Background(), `delete from QueueSettings`)
+				// can't `defer db.Close()`
+				return model.NewSettingsStorePostgres(db)
+			},
+		},
+		{
+			"sqlite", func(*testing.T) model.SettingsStore {
+				db, _ := model.OpenSqlite(":memory:")
+				return model.NewSettingsStoreSqlite(db)
+			},
+		},
+	}
+	for _, row := range table {
+		t.Run(row.label, func(t *testing.T) {
+			require := require.New(t)
+			settings := row.factory(t)
+
+			have, err := settings.Load(ctx, "ranked")
+			require.Nil(err)
+			require.Nil(have)
+
+			require.Nil(settings.Save(ctx, "ranked", map[string]string{"TUNING_GRID_SIDE": "8"}))
+			require.Nil(settings.Save(ctx, "casual", map[string]string{"TUNING_SKILL_AXIS": "log"}))
+
+			// replaced as a whole
+			require.Nil(settings.Save(ctx, "ranked", map[string]string{"TUNING_SKILL_CEIL": "100"}))
+			have, err = settings.Load(ctx, "ranked")
+			require.Nil(err)
+			require.Equal(map[string]string{"TUNING_SKILL_CEIL": "100"}, have)
+
+			have, err = settings.Load(ctx, "casual")
+			require.Nil(err)
+			require.Equal(map[string]string{"TUNING_SKILL_AXIS": "log"}, have)
+		})
+	}
+}
+
+func TestSettingsStoreRestart(t *testing.T) {
+	table := []struct {
+		label string
+		open  func(dir string) (model.SettingsStore, func())
+	}{
+		{
+			"durable", func(dir string) (model.SettingsStore, func()) {
+				settings, err := model.NewSettingsStoreDurable(dir)
+				require.Nil(t, err)
+				return settings, func() {}
+			},
+		},
+		{
+			"sqlite", func(dir string) (model.SettingsStore, func()) {
+				db, err := model.OpenSqlite(filepath.Join(dir, "settings.db"))
+				require.Nil(t, err)
+				return model.NewSettingsStoreSqlite(db), func() { db.Close() }
+			},
+		},
+	}
+	for _, row := range table {
+		t.Run(row.label, func(t *testing.T) {
+			require := require.New(t)
+			dir := t.TempDir()
+
+			settings, closeDb := row.open(dir)
+			require.Nil(settings.Save(ctx, "ranked", map[string]string{"TUNING_GRID_SIDE": "8"}))
+			closeDb()
+
+			settings, closeDb = row.open(dir)
+			defer closeDb()
+			have, err := settings.Load(ctx, "ranked")
+			require.Nil(err)
+			require.Equal(map[string]string{"TUNING_GRID_SIDE": "8"}, have)
+		})
+	}
+}
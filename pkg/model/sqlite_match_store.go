@@ -0,0 +1,203 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// the columns of a match, in the order of scanSqliteMatch
+const sqliteMatchColumns = `
+	Serial, Queue, FormedAt,
+	SkillMin, SkillAverage, SkillMax, SkillDeviation,
+	LatencyMin, LatencyAverage, LatencyMax, LatencyDeviation,
+	WaitMin, WaitAverage, WaitMax, WaitDeviation,
+	Teams, SkillDelta, Roles, Region, Quality,
+	(select json_group_array(Name order by Position)
+		from MatchMembers
+		where MatchMembers.Serial = Matches.Serial)`
+
+// the db is opened by OpenSqlite, the queues and the matches share it
+func NewMatchStoreSqlite(db *sql.DB) MatchStore {
+	return &sqliteMatchStore{
+		db: db,
+	}
+}
+
+// the serials are autoincrement, so they never repeat, even after the matches are deleted
+type sqliteMatchStore struct {
+	db *sql.DB
+}
+
+func (m *sqliteMatchStore) Add(ctx context.Context, match *schema.MatchResponse) error {
+	teams, err := nullJson(match.Teams, match.Teams == nil)
+	if err != nil {
+		return err
+	}
+	roles, err := nullJson(match.Roles, match.Roles == nil)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+		insert into Matches
+			(Queue, FormedAt,
+			SkillMin, SkillAverage, SkillMax, SkillDeviation,
+			LatencyMin, LatencyAverage, LatencyMax, LatencyDeviation,
+			WaitMin, WaitAverage, WaitMax, WaitDeviation,
+			Teams, SkillDelta, Roles, Region, Quality)
+		values
+			(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		returning Serial`,
+		match.Queue, match.FormedAt.UnixNano(),
+		match.Skill.Min, match.Skill.Average, match.Skill.Max, match.Skill.Deviation,
+		match.Latency.Min, match.Latency.Average, match.Latency.Max, match.Latency.Deviation,
+		match.WaitSeconds.Min, match.WaitSeconds.Average, match.WaitSeconds.Max, match.WaitSeconds.Deviation,
+		teams, match.SkillDelta, roles, match.Region, match.Quality)
+
+	serial := 0
+	err = row.Scan(&serial)
+	if err != nil {
+		return err
+	}
+
+	names, err := nameList(match.Names)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		insert into MatchMembers
+			(Serial, Position, Name)
+		select ?, key + 1, value
+		from json_each(?)`,
+		serial, names)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	match.Serial = serial
+	return nil
+}
+
+// nullJson marshals the value, or stores a null
+func nullJson(value any, null bool) (sql.NullString, error) {
+	if null {
+		return sql.NullString{}, nil
+	}
+	packed, err := json.Marshal(value)
+	return sql.NullString{String: string(packed), Valid: true}, err
+}
+
+func (m *sqliteMatchStore) Get(ctx context.Context, serial int) (*schema.MatchResponse, error) {
+	row := m.db.QueryRowContext(ctx, `
+		select `+sqliteMatchColumns+`
+		from Matches
+		where Serial = ?`,
+		serial)
+
+	match, err := scanSqliteMatch(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoMatch
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &match, nil
+}
+
+func (m *sqliteMatchStore) List(ctx context.Context, since int, limit int) ([]schema.MatchResponse, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		select `+sqliteMatchColumns+`
+		from Matches
+		where Serial > ?
+		order by Serial
+		limit ?`,
+		since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectSqliteMatches(rows)
+}
+
+func (m *sqliteMatchStore) ListUser(ctx context.Context, name string, since int, limit int) ([]schema.MatchResponse, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		select `+sqliteMatchColumns+`
+		from Matches
+		where Serial in (
+			select Serial
+			from MatchMembers
+			where Name = ? and Serial > ?)
+		order by Serial
+		limit ?`,
+		name, since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectSqliteMatches(rows)
+}
+
+func collectSqliteMatches(rows *sql.Rows) ([]schema.MatchResponse, error) {
+	defer rows.Close()
+
+	matches := []schema.MatchResponse{}
+	for rows.Next() {
+		match, err := scanSqliteMatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+
+	return matches, rows.Err()
+}
+
+func scanSqliteMatch(row interface{ Scan(...any) error }) (schema.MatchResponse, error) {
+	match := schema.MatchResponse{}
+	var formedAt int64
+	var teams, roles sql.NullString
+	var names string
+	err := row.Scan(
+		&match.Serial, &match.Queue, &formedAt,
+		&match.Skill.Min, &match.Skill.Average, &match.Skill.Max, &match.Skill.Deviation,
+		&match.Latency.Min, &match.Latency.Average, &match.Latency.Max, &match.Latency.Deviation,
+		&match.WaitSeconds.Min, &match.WaitSeconds.Average, &match.WaitSeconds.Max, &match.WaitSeconds.Deviation,
+		&teams, &match.SkillDelta, &roles, &match.Region, &match.Quality,
+		&names)
+	if err != nil {
+		return match, err
+	}
+
+	match.FormedAt = time.Unix(0, formedAt).UTC()
+	if teams.Valid {
+		err = json.Unmarshal([]byte(teams.String), &match.Teams)
+		if err != nil {
+			return match, err
+		}
+	}
+	if roles.Valid {
+		err = json.Unmarshal([]byte(roles.String), &match.Roles)
+		if err != nil {
+			return match, err
+		}
+	}
+	err = json.Unmarshal([]byte(names), &match.Names)
+	return match, err
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// the db is opened by OpenSqlite, the queues and the settings share it
+func NewSettingsStoreSqlite(db *sql.DB) SettingsStore {
+	return &sqliteSettingsStore{
+		db: db,
+	}
+}
+
+type sqliteSettingsStore struct {
+	db *sql.DB
+}
+
+func (m *sqliteSettingsStore) Load(ctx context.Context, queue string) (map[string]string, error) {
+	row := m.db.QueryRowContext(ctx, `
+		select Settings
+		from QueueSettings
+		where Queue = ?`,
+		queue)
+
+	raw := ""
+	err := row.Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var settings map[string]string
+	err = json.Unmarshal([]byte(raw), &settings)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (m *sqliteSettingsStore) Save(ctx context.Context, queue string, settings map[string]string) error {
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.db.ExecContext(ctx, `
+		insert into QueueSettings (Queue, Settings)
+		values (?, ?)
+		on conflict (Queue) do update
+		set Settings = excluded.Settings`,
+		queue, string(raw))
+	return err
+}
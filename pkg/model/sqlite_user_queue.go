@@ -0,0 +1,568 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/schema"
+	_ "modernc.org/sqlite"
+)
+
+// the same table as the postgres one, the timestamps are unix nanoseconds and the arrays are json
+const sqliteSchema = `
+	create table if not exists UserQueue (
+		Queue text not null,
+		Name text not null,
+		Skill real not null,
+		Latency real not null,
+		QueuedAt integer not null,
+		SeenAt integer not null,
+		PosS integer not null,
+		PosL integer not null,
+		Party text not null default '',
+		Roles text not null default '[]',
+		Latencies text,
+		primary key (Queue, Name)
+	);
+
+	create index if not exists UserQueue_Pos on UserQueue (Queue, PosS, PosL);
+	create index if not exists UserQueue_Party on UserQueue (Queue, Party) where Party <> '';
+
+	create table if not exists Matches (
+		Serial integer primary key autoincrement,
+		Queue text not null,
+		FormedAt integer not null,
+		SkillMin real not null,
+		SkillAverage real not null,
+		SkillMax real not null,
+		SkillDeviation real not null,
+		LatencyMin real not null,
+		LatencyAverage real not null,
+		LatencyMax real not null,
+		LatencyDeviation real not null,
+		WaitMin real not null,
+		WaitAverage real not null,
+		WaitMax real not null,
+		WaitDeviation real not null,
+		Teams text,
+		SkillDelta real not null,
+		Roles text,
+		Region text not null,
+		Quality real not null
+	);
+
+	create table if not exists MatchMembers (
+		Serial integer not null references Matches (Serial) on delete cascade,
+		Position integer not null,
+		Name text not null,
+		primary key (Serial, Position)
+	);
+
+	create index if not exists MatchMembers_Name on MatchMembers (Name);
+
+	create table if not exists QueueSettings (
+		Queue text primary key,
+		Settings text not null
+	);`
+
+// OpenSqlite opens the database file (or ":memory:") and creates the tables.
+// Sqlite has a single writer anyway, so the queues share a single connection
+func OpenSqlite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// an in-memory database lives as long as its connection
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+
+	_, err = db.Exec(`pragma journal_mode = wal`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = upgradeSqlite(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// upgradeSqlite adds the columns missing from the files made by the older versions
+func upgradeSqlite(db *sql.DB) error {
+	row := db.QueryRow(`select count(*) from pragma_table_info('UserQueue') where name = 'SeenAt'`)
+	exists := 0
+	err := row.Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+
+	_, err = db.Exec(`
+		alter table UserQueue add column SeenAt integer not null default 0;
+		update UserQueue set SeenAt = QueuedAt;`)
+	return err
+}
+
+// the queues share the table, each one only sees its own rows
+func NewUserQueueSqlite(cfg GridConfig, db *sql.DB, queue string) UserQueue {
+	return &sqliteUserQueue{
+		GridConfig: cfg,
+		db:         db,
+		queue:      queue,
+	}
+}
+
+type sqliteUserQueue struct {
+	GridConfig
+	// held for reading while the users are placed, and for writing while they are moved
+	grid  sync.RWMutex
+	db    *sql.DB
+	queue string
+}
+
+// the columns of a user, in the order of scanUser
+const sqliteUserColumns = `Name, Skill, Latency, QueuedAt, SeenAt, Party, Roles, Latencies`
+
+func (m *sqliteUserQueue) Parse(req *schema.QueueUserRequest) (*QueuedUser, error) {
+	return parse(req)
+}
+
+func (m *sqliteUserQueue) ParseParty(req *schema.QueuePartyRequest) ([]*QueuedUser, error) {
+	return parseParty(req)
+}
+
+func (m *sqliteUserQueue) Add(ctx context.Context, user *QueuedUser) error {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	m.observe([]*QueuedUser{user})
+	return m.insert(ctx, m.db, user, toIndex(user, &m.GridConfig))
+}
+
+func (m *sqliteUserQueue) AddParty(ctx context.Context, members []*QueuedUser) error {
+	m.grid.RLock()
+	defer m.grid.RUnlock()
+
+	m.observe(members)
+	idx := partyIndex(members, &m.GridConfig)
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the first write takes the single writer lock, so the members are inserted
+	// before the check: no other add can slip in between them
+	for _, user := range members {
+		err := m.insert(ctx, tx, user, idx)
+		if err != nil {
+			return err
+		}
+	}
+
+	row := tx.QueryRowContext(ctx, `
+		select count(*)
+		from UserQueue
+		where Queue = ? and Party = ?`,
+		m.queue, members[0].Party)
+	count := 0
+	err = row.Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > len(members) {
+		return fmt.Errorf("party already exists")
+	}
+
+	return tx.Commit()
+}
+
+// the common part of a db and a transaction
+type sqliteExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (m *sqliteUserQueue) insert(ctx context.Context, db sqliteExecutor, user *QueuedUser, idx BinIdx) error {
+	roles, err := json.Marshal(roleArray(user.Roles))
+	if err != nil {
+		return err
+	}
+	latencies, err := json.Marshal(user.Latencies)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		insert into UserQueue
+			(Queue, Name, Skill, Latency, QueuedAt, SeenAt, PosS, PosL, Party, Roles, Latencies)
+		values
+			(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.queue, user.Name, user.Skill, user.Latency, user.QueuedAt.UnixNano(), lastSeen(user).UnixNano(), idx.S, idx.L, user.Party, string(roles), string(latencies))
+	return err
+}
+
+// scanUser reads a row of sqliteUserColumns, followed by the extra columns
+func scanUser(row interface{ Scan(...any) error }, extra ...any) (*QueuedUser, error) {
+	user := QueuedUser{}
+	var queuedAt, seenAt int64
+	var roles string
+	var latencies sql.NullString
+	dest := append([]any{&user.Name, &user.Skill, &user.Latency, &queuedAt, &seenAt, &user.Party, &roles, &latencies}, extra...)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	user.QueuedAt = time.Unix(0, queuedAt).UTC()
+	user.SeenAt = time.Unix(0, seenAt).UTC()
+	err = json.Unmarshal([]byte(roles), &user.Roles)
+	if err != nil {
+		return nil, err
+	}
+	if latencies.Valid {
+		err = json.Unmarshal([]byte(latencies.String), &user.Latencies)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// scanUsers reads the rows of sqliteUserColumns, then closes them
+func scanUsers(rows *sql.Rows) ([]*QueuedUser, error) {
+	defer rows.Close()
+
+	users := []*QueuedUser{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (m *sqliteUserQueue) GetBin(ctx context.Context, idx BinIdx) ([]*QueuedUser, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		select `+sqliteUserColumns+`
+		from UserQueue
+		where Queue = ? and PosS = ? and PosL = ?`,
+		m.queue, idx.S, idx.L)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+func (m *sqliteUserQueue) GetRect(ctx context.Context, lo BinIdx, hi BinIdx, minWait time.Duration) ([]*QueuedUser, error) {
+	// todo: this might not be a great idea
+	// todo: different func calls will have different now-s
+	now := time.Now().UTC()
+	before := now.Add(-minWait)
+
+	rows, err := m.db.QueryContext(ctx, `
+		select `+sqliteUserColumns+`
+		from UserQueue
+		where
+			Queue = ? and
+			PosS >= ? and PosL >= ? and
+			PosS <= ? and PosL <= ? and
+			QueuedAt <= ?`,
+		m.queue, lo.S, lo.L, hi.S, hi.L, before.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+func (m *sqliteUserQueue) GetGrid(ctx context.Context, minWait time.Duration) (map[BinIdx][]*QueuedUser, error) {
+	// without a wait, the users queued with a clock ahead are not skipped
+	before := time.Now().UTC().Add(-minWait)
+	if minWait <= 0 {
+		before = time.Now().UTC().Add(24 * time.Hour)
+	}
+
+	rows, err := m.db.QueryContext(ctx, `
+		select `+sqliteUserColumns+`, PosS, PosL
+		from UserQueue
+		where Queue = ? and QueuedAt <= ?`,
+		m.queue, before.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grid := make(map[BinIdx][]*QueuedUser)
+	for rows.Next() {
+		idx := BinIdx{}
+		user, err := scanUser(rows, &idx.S, &idx.L)
+		if err != nil {
+			return nil, err
+		}
+		grid[idx] = append(grid[idx], user)
+	}
+
+	return grid, rows.Err()
+}
+
+func (m *sqliteUserQueue) Occupied(ctx context.Context) (map[BinIdx]int, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		select PosS, PosL, count(*)
+		from UserQueue
+		where Queue = ?
+		group by PosS, PosL`,
+		m.queue)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[BinIdx]int)
+	for rows.Next() {
+		idx := BinIdx{}
+		count := 0
+		err := rows.Scan(&idx.S, &idx.L, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[idx] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// nameList passes the names as a json array, to be read by json_each
+func nameList(names []string) (string, error) {
+	list, err := json.Marshal(names)
+	return string(list), err
+}
+
+func (m *sqliteUserQueue) Remove(ctx context.Context, users []string) error {
+	list, err := nameList(users)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.db.ExecContext(ctx, `
+		delete from UserQueue
+		where Queue = ? and Name in (select value from json_each(?))`,
+		m.queue, list)
+	return err
+}
+
+// Claim is a single statement, sqlite runs it in isolation from the other writers
+func (m *sqliteUserQueue) Claim(ctx context.Context, users []string) (bool, error) {
+	list, err := nameList(users)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := m.db.ExecContext(ctx, `
+		delete from UserQueue
+		where
+			Queue = ?1 and Name in (select value from json_each(?2)) and
+			(select count(*)
+				from UserQueue
+				where Queue = ?1 and Name in (select value from json_each(?2))) = ?3`,
+		m.queue, list, len(users))
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return deleted == int64(len(users)), nil
+}
+
+func (m *sqliteUserQueue) Delete(ctx context.Context, name string) error {
+	result, err := m.db.ExecContext(ctx, `
+		delete from UserQueue
+		where
+			Queue = ?1 and (
+				Name = ?2 or
+				Party in (
+					select Party
+					from UserQueue
+					where Queue = ?1 and Name = ?2 and Party <> ''))`,
+		m.queue, name)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotQueued
+	}
+	return nil
+}
+
+func (m *sqliteUserQueue) Heartbeat(ctx context.Context, name string) error {
+	result, err := m.db.ExecContext(ctx, `
+		update UserQueue
+		set SeenAt = ?3
+		where
+			Queue = ?1 and (
+				Name = ?2 or
+				Party in (
+					select Party
+					from UserQueue
+					where Queue = ?1 and Name = ?2 and Party <> ''))`,
+		m.queue, name, time.Now().UTC().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotQueued
+	}
+	return nil
+}
+
+func (m *sqliteUserQueue) Expire(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		delete from UserQueue
+		where
+			Queue = ?1 and (
+				SeenAt < ?2 or
+				Party in (
+					select Party
+					from UserQueue
+					where Queue = ?1 and SeenAt < ?2 and Party <> ''))
+		returning Name`,
+		m.queue, before.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		name := ""
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+func (m *sqliteUserQueue) Count(ctx context.Context) (int, error) {
+	row := m.db.QueryRowContext(ctx, `
+		select count(*)
+		from UserQueue
+		where Queue = ?`,
+		m.queue)
+
+	count := 0
+	err := row.Scan(&count)
+	if err != nil {
+		return -1, err
+	}
+
+	return count, nil
+}
+
+func (m *sqliteUserQueue) Status(ctx context.Context, name string, radius int) (*UserStatus, error) {
+	status := UserStatus{}
+	idx := &status.Bin
+
+	row := m.db.QueryRowContext(ctx, `
+		select `+sqliteUserColumns+`, PosS, PosL
+		from UserQueue
+		where Queue = ? and Name = ?`,
+		m.queue, name)
+	user, err := scanUser(row, &idx.S, &idx.L)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotQueued
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.QueuedUser = *user
+
+	row = m.db.QueryRowContext(ctx, `
+		select
+			count(*) filter (where PosS = ?1 and PosL = ?2 and QueuedAt < ?4),
+			count(*) filter (where PosS = ?1 and PosL = ?2),
+			count(*) filter (where PosS <> ?1 or PosL <> ?2)
+		from UserQueue
+		where
+			Queue = ?6 and Name <> ?5 and
+			PosS >= ?1 - ?3 and PosL >= ?2 - ?3 and
+			PosS <= ?1 + ?3 and PosL <= ?2 + ?3`,
+		idx.S, idx.L, radius, status.QueuedAt.UnixNano(), name, m.queue)
+	err = row.Scan(&status.Position, &status.BinCount, &status.NeighbourCount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// Reconfigure moves the users in a single transaction
+func (m *sqliteUserQueue) Reconfigure(ctx context.Context, cfg GridConfig) error {
+	m.grid.Lock()
+	defer m.grid.Unlock()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		select `+sqliteUserColumns+`
+		from UserQueue
+		where Queue = ?`,
+		m.queue)
+	if err != nil {
+		return err
+	}
+	users, err := scanUsers(rows)
+	if err != nil {
+		return err
+	}
+
+	for name, idx := range rebin(users, &cfg) {
+		_, err := tx.ExecContext(ctx, `
+			update UserQueue
+			set PosS = ?, PosL = ?
+			where Queue = ? and Name = ?`,
+			idx.S, idx.L, m.queue, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	m.GridConfig = cfg
+	return nil
+}
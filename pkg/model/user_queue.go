@@ -2,17 +2,33 @@ package model
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/starnuik/golang_match/pkg/schema"
 )
 
+var ErrNotQueued = errors.New("user is not queued")
+
+// the queue of a deployment with a single queue
+const DefaultQueue = "default"
+
 type QueuedUser struct {
 	Name     string
 	Skill    float64
 	Latency  float64
 	QueuedAt time.Time
+	// the last heartbeat, QueuedAt if there was none
+	SeenAt time.Time
+	// empty for the users that have queued alone
+	Party string
+	// by preference, any role if empty
+	Roles []string
+	// region -> latency, Latency is the lowest of these
+	Latencies map[string]float64
 }
 
 type BinIdx struct {
@@ -20,42 +36,192 @@ type BinIdx struct {
 	L int // Latency
 }
 
+type PartyAggregate string
+
+const (
+	AggregateMean PartyAggregate = "mean"
+	AggregateMax  PartyAggregate = "max"
+)
+
 type GridConfig struct {
 	SkillCeil   float64
 	LatencyCeil float64
 	Side        int
+	// how a party is positioned in the grid, defaults to AggregateMean
+	PartyAggregate PartyAggregate
+	// how the values are spread over the bins, default to LinearAxis
+	SkillAxis   Axis
+	LatencyAxis Axis
+}
+
+func (cfg *GridConfig) ToIndex(user *QueuedUser) BinIdx {
+	return toIndex(user, cfg)
+}
+
+type UserStatus struct {
+	QueuedUser
+	Bin            BinIdx
+	Position       int // users in the same bin, that were queued earlier
+	BinCount       int // other users in the same bin
+	NeighbourCount int // users in the bins around, the own bin excluded
 }
 
 type UserQueue interface {
 	Parse(*schema.QueueUserRequest) (*QueuedUser, error)
+	ParseParty(*schema.QueuePartyRequest) ([]*QueuedUser, error)
 	Add(context.Context, *QueuedUser) error
+	// AddParty puts all of the members into the same bin, or none of them
+	AddParty(context.Context, []*QueuedUser) error
 	GetBin(context.Context, BinIdx) ([]*QueuedUser, error)
 	GetRect(ctx context.Context, lo BinIdx, hi BinIdx, minWait time.Duration) ([]*QueuedUser, error)
+	// GetGrid returns every bin that has users, in a single read. With minWait > 0 only the users
+	// that have waited for at least as long are returned
+	GetGrid(ctx context.Context, minWait time.Duration) (map[BinIdx][]*QueuedUser, error)
+	// Occupied counts the users of every bin that has any, without reading the users
+	Occupied(context.Context) (map[BinIdx]int, error)
 	Remove(context.Context, []string) error
+	// Claim takes the users of a formed group out, all of them or none.
+	// Returns false if any of them has left or has been claimed by another group meanwhile
+	Claim(context.Context, []string) (bool, error)
+	// Delete removes a single user along with their party, returns ErrNotQueued if there is no such user
+	Delete(context.Context, string) error
 	Count(context.Context) (int, error)
+	// Status returns ErrNotQueued if there is no such user
+	Status(ctx context.Context, name string, radius int) (*UserStatus, error)
+	// Heartbeat marks the user and their party as seen now, returns ErrNotQueued if there is no such user
+	Heartbeat(context.Context, string) error
+	// Expire removes the users last seen before the time, along with their parties. Returns the removed names
+	Expire(ctx context.Context, before time.Time) ([]string, error)
+	// Reconfigure moves every queued user into their bin of the new grid, QueuedAt is kept
+	Reconfigure(context.Context, GridConfig) error
 }
 
 func parse(req *schema.QueueUserRequest) (*QueuedUser, error) {
+	latency := req.Latency
+	for region, regional := range req.Latencies {
+		if regional <= 0 {
+			return nil, fmt.Errorf("latency to %s <= 0", region)
+		}
+		if req.Latency == 0 && (latency == 0 || regional < latency) {
+			latency = regional
+		}
+	}
+
 	if req.Skill <= 0 {
 		return nil, fmt.Errorf("skill <= 0")
 	}
-	if req.Latency <= 0 {
+	if latency <= 0 {
 		return nil, fmt.Errorf("latency <= 0")
 	}
 	if len(req.Name) == 0 {
 		return nil, fmt.Errorf("empty name")
 	}
+
+	roles := make(map[string]struct{})
+	for _, role := range req.Roles {
+		if len(role) == 0 {
+			return nil, fmt.Errorf("empty role")
+		}
+		if _, exists := roles[role]; exists {
+			return nil, fmt.Errorf("duplicate role %s", role)
+		}
+		roles[role] = struct{}{}
+	}
+
+	now := time.Now().UTC()
 	return &QueuedUser{
-		Name:     req.Name,
-		Skill:    req.Skill,
-		Latency:  req.Latency,
-		QueuedAt: time.Now().UTC(),
+		Name:      req.Name,
+		Skill:     req.Skill,
+		Latency:   latency,
+		QueuedAt:  now,
+		SeenAt:    now,
+		Roles:     slices.Clone(req.Roles),
+		Latencies: maps.Clone(req.Latencies),
 	}, nil
 }
 
+func parseParty(req *schema.QueuePartyRequest) ([]*QueuedUser, error) {
+	if len(req.Name) == 0 {
+		return nil, fmt.Errorf("empty party name")
+	}
+	if len(req.Members) == 0 {
+		return nil, fmt.Errorf("empty party")
+	}
+
+	now := time.Now().UTC()
+	names := make(map[string]struct{})
+	members := make([]*QueuedUser, 0, len(req.Members))
+	for idx := range req.Members {
+		user, err := parse(&req.Members[idx])
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := names[user.Name]; exists {
+			return nil, fmt.Errorf("duplicate member %s", user.Name)
+		}
+		names[user.Name] = struct{}{}
+
+		user.Party = req.Name
+		user.QueuedAt = now
+		user.SeenAt = now
+		members = append(members, user)
+	}
+	return members, nil
+}
+
+// lastSeen is SeenAt, the users made without one were seen when queued
+func lastSeen(user *QueuedUser) time.Time {
+	if user.SeenAt.IsZero() {
+		return user.QueuedAt
+	}
+	return user.SeenAt
+}
+
+func partyIndex(members []*QueuedUser, cfg *GridConfig) BinIdx {
+	center := QueuedUser{}
+	for _, user := range members {
+		switch cfg.PartyAggregate {
+		case AggregateMax:
+			center.Skill = max(center.Skill, user.Skill)
+			center.Latency = max(center.Latency, user.Latency)
+		default:
+			center.Skill += user.Skill / float64(len(members))
+			center.Latency += user.Latency / float64(len(members))
+		}
+	}
+	return toIndex(&center, cfg)
+}
+
+// rebin returns the bins of the users in the new grid, the party members are placed together.
+// The axes of the new grid learn from the users first
+func rebin(users []*QueuedUser, cfg *GridConfig) map[string]BinIdx {
+	cfg.observe(users)
+
+	parties := make(map[string][]*QueuedUser)
+	for _, user := range users {
+		if user.Party != "" {
+			parties[user.Party] = append(parties[user.Party], user)
+		}
+	}
+
+	bins := make(map[string]BinIdx, len(users))
+	for _, user := range users {
+		if user.Party == "" {
+			bins[user.Name] = toIndex(user, cfg)
+		}
+	}
+	for _, members := range parties {
+		idx := partyIndex(members, cfg)
+		for _, user := range members {
+			bins[user.Name] = idx
+		}
+	}
+	return bins
+}
+
 func toIndex(req *QueuedUser, cfg *GridConfig) BinIdx {
 	return BinIdx{
-		S: remap(req.Skill, cfg.SkillCeil, cfg.Side),
-		L: remap(req.Latency, cfg.LatencyCeil, cfg.Side),
+		S: remap(axisOrLinear(cfg.SkillAxis).Normalize(req.Skill, cfg.SkillCeil), cfg.Side),
+		L: remap(axisOrLinear(cfg.LatencyAxis).Normalize(req.Latency, cfg.LatencyCeil), cfg.Side),
 	}
 }
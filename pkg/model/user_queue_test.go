@@ -2,7 +2,11 @@ package model_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,24 +25,31 @@ var (
 		LatencyCeil: 10,
 		Side:        2,
 	}
-	wantUsers = []*model.QueuedUser{
-		{Skill: 2.5, Latency: 2.5, Name: "user0-bin00", QueuedAt: now().Add(-100 * time.Second)},
-		{Skill: 1.25, Latency: 2.5, Name: "user1-bin00", QueuedAt: now().Add(-200 * time.Second)},
-		{Skill: 2.5, Latency: 1.25, Name: "user2-bin00", QueuedAt: now().Add(-300 * time.Second)},
-		{Skill: 1.25, Latency: 1.25, Name: "user3-bin00", QueuedAt: now().Add(-400 * time.Second)},
-		{Skill: 7.5, Latency: 2.5, Name: "user4-bin10", QueuedAt: now().Add(-500 * time.Second)},
-		{Skill: 7.5, Latency: 2.5, Name: "user5-bin10", QueuedAt: now().Add(-600 * time.Second)},
-		{Skill: 7.5, Latency: 2.5, Name: "user6-bin10", QueuedAt: now().Add(-700 * time.Second)},
-		{Skill: 2.5, Latency: 7.5, Name: "user7-bin01", QueuedAt: now().Add(-800 * time.Second)},
-		{Skill: 2.5, Latency: 7.5, Name: "user8-bin01", QueuedAt: now().Add(-900 * time.Second)},
-		{Skill: 7.5, Latency: 7.5, Name: "user9-bin11", QueuedAt: now().Add(-1000 * time.Second)},
-	}
+	// the tests that cut by the wait build their own, so the time spent by the earlier tests doesn't matter
+	wantUsers = newWantUsers(now())
 )
 
+// newWantUsers are 4 users in bin {0, 0}, 3 in {1, 0}, 2 in {0, 1} and 1 in {1, 1},
+// queued at 100s, 200s, ... 1000s before at
+func newWantUsers(at time.Time) []*model.QueuedUser {
+	return []*model.QueuedUser{
+		{Skill: 2.5, Latency: 2.5, Name: "user0-bin00", QueuedAt: at.Add(-100 * time.Second), Roles: []string{"tank", "damage"}},
+		{Skill: 1.25, Latency: 2.5, Name: "user1-bin00", QueuedAt: at.Add(-200 * time.Second)},
+		{Skill: 2.5, Latency: 1.25, Name: "user2-bin00", QueuedAt: at.Add(-300 * time.Second)},
+		{Skill: 1.25, Latency: 1.25, Name: "user3-bin00", QueuedAt: at.Add(-400 * time.Second)},
+		{Skill: 7.5, Latency: 2.5, Name: "user4-bin10", QueuedAt: at.Add(-500 * time.Second), Roles: []string{"healer"}},
+		{Skill: 7.5, Latency: 2.5, Name: "user5-bin10", QueuedAt: at.Add(-600 * time.Second)},
+		{Skill: 7.5, Latency: 2.5, Name: "user6-bin10", QueuedAt: at.Add(-700 * time.Second)},
+		{Skill: 2.5, Latency: 7.5, Name: "user7-bin01", QueuedAt: at.Add(-800 * time.Second)},
+		{Skill: 2.5, Latency: 7.5, Name: "user8-bin01", QueuedAt: at.Add(-900 * time.Second)},
+		{Skill: 7.5, Latency: 7.5, Name: "user9-bin11", QueuedAt: at.Add(-1000 * time.Second)},
+	}
+}
+
 func TestUserQueueAdd(t *testing.T) {
 	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
 		require := require.New(t)
-		users := factory(cfg)
+		users := factory(t, cfg)
 
 		err := users.Add(ctx, wantUsers[0])
 		require.Nil(err)
@@ -54,7 +65,7 @@ func TestUserQueueAdd(t *testing.T) {
 func TestUserQueueGet(t *testing.T) {
 	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
 		require := require.New(t)
-		users := factory(cfg)
+		users := factory(t, cfg)
 
 		bin, err := users.GetBin(ctx, model.BinIdx{0, 0})
 		require.Nil(err)
@@ -95,7 +106,7 @@ func TestUserQueueGet(t *testing.T) {
 func TestUserQueueCount(t *testing.T) {
 	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
 		require := require.New(t)
-		users := factory(cfg)
+		users := factory(t, cfg)
 
 		count, err := users.Count(ctx)
 		require.Nil(err)
@@ -116,18 +127,20 @@ func TestUserQueueCount(t *testing.T) {
 func TestUserQueueParse(t *testing.T) {
 	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
 		require := require.New(t)
-		users := factory(model.GridConfig{})
+		users := factory(t, model.GridConfig{})
 
 		want := schema.QueueUserRequest{
 			Name:    "bob",
 			Skill:   13,
 			Latency: 37,
+			Roles:   []string{"healer", "tank"},
 		}
 		have, err := users.Parse(&want)
 		require.Nil(err)
 		require.Equal(want.Name, have.Name)
 		require.Equal(want.Skill, have.Skill)
 		require.Equal(want.Latency, have.Latency)
+		require.Equal(want.Roles, have.Roles)
 
 		invalid := want
 		invalid.Skill = -13
@@ -146,13 +159,25 @@ func TestUserQueueParse(t *testing.T) {
 		have, err = users.Parse(&invalid)
 		require.Nil(have)
 		require.Error(err)
+
+		invalid = want
+		invalid.Roles = []string{"tank", "tank"}
+		have, err = users.Parse(&invalid)
+		require.Nil(have)
+		require.Error(err)
+
+		invalid = want
+		invalid.Roles = []string{""}
+		have, err = users.Parse(&invalid)
+		require.Nil(have)
+		require.Error(err)
 	})
 }
 
 func TestUserQueueRemove(t *testing.T) {
 	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
 		require := require.New(t)
-		users := factory(cfg)
+		users := factory(t, cfg)
 
 		for _, user := range wantUsers {
 			err := users.Add(ctx, user)
@@ -188,10 +213,149 @@ func TestUserQueueRemove(t *testing.T) {
 	})
 }
 
+func TestUserQueueDelete(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		require := require.New(t)
+		users := factory(t, cfg)
+
+		err := users.Delete(ctx, wantUsers[0].Name)
+		require.ErrorIs(err, model.ErrNotQueued)
+
+		for _, user := range wantUsers {
+			err := users.Add(ctx, user)
+			require.Nil(err)
+		}
+
+		err = users.Delete(ctx, wantUsers[4].Name)
+		require.Nil(err)
+
+		err = users.Delete(ctx, wantUsers[4].Name)
+		require.ErrorIs(err, model.ErrNotQueued)
+
+		count, err := users.Count(ctx)
+		require.Nil(err)
+		require.Equal(len(wantUsers)-1, count)
+
+		bin, err := users.GetBin(ctx, model.BinIdx{1, 0})
+		require.Nil(err)
+		require.Len(bin, 2)
+		require.False(binContains(bin, wantUsers[4]))
+
+		err = users.Delete(ctx, wantUsers[9].Name)
+		require.Nil(err)
+
+		bin, err = users.GetBin(ctx, model.BinIdx{1, 1})
+		require.Nil(err)
+		require.Len(bin, 0)
+
+		// the name can be reused after leaving the queue
+		err = users.Add(ctx, wantUsers[4])
+		require.Nil(err)
+	})
+}
+
+func TestUserQueueStatus(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		require := require.New(t)
+		users := factory(t, cfg)
+
+		have, err := users.Status(ctx, wantUsers[0].Name, 1)
+		require.Nil(have)
+		require.ErrorIs(err, model.ErrNotQueued)
+
+		for _, user := range wantUsers {
+			err := users.Add(ctx, user)
+			require.Nil(err)
+		}
+
+		have, err = users.Status(ctx, wantUsers[1].Name, 1)
+		require.Nil(err)
+		require.True(binContains([]*model.QueuedUser{&have.QueuedUser}, wantUsers[1]))
+		require.Equal(model.BinIdx{0, 0}, have.Bin)
+		require.Equal(2, have.Position)
+		require.Equal(3, have.BinCount)
+		require.Equal(6, have.NeighbourCount)
+
+		have, err = users.Status(ctx, wantUsers[9].Name, 0)
+		require.Nil(err)
+		require.Equal(model.BinIdx{1, 1}, have.Bin)
+		require.Equal(0, have.Position)
+		require.Equal(0, have.BinCount)
+		require.Equal(0, have.NeighbourCount)
+	})
+}
+
+func TestUserQueueParty(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		require := require.New(t)
+		users := factory(t, cfg)
+
+		req := schema.QueuePartyRequest{
+			Name: "party0",
+			Members: []schema.QueueUserRequest{
+				{Name: "member0", Skill: 1, Latency: 1},
+				{Name: "member1", Skill: 9, Latency: 1},
+			},
+		}
+		party, err := users.ParseParty(&req)
+		require.Nil(err)
+		require.Len(party, 2)
+		require.Equal("party0", party[0].Party)
+		require.Equal(party[0].QueuedAt, party[1].QueuedAt)
+
+		err = users.AddParty(ctx, party)
+		require.Nil(err)
+		err = users.Add(ctx, wantUsers[4])
+		require.Nil(err)
+
+		// placed by the mean skill and latency
+		bin, err := users.GetBin(ctx, model.BinIdx{1, 0})
+		require.Nil(err)
+		require.Len(bin, 3)
+		require.True(binContains(bin, party[0]))
+		require.True(binContains(bin, party[1]))
+
+		err = users.AddParty(ctx, party)
+		require.Error(err)
+
+		// a reused party name
+		other := []*model.QueuedUser{{Name: "member2", Skill: 1, Latency: 1, QueuedAt: now(), Party: "party0"}}
+		err = users.AddParty(ctx, other)
+		require.Error(err)
+
+		// leaving takes the whole party out
+		err = users.Delete(ctx, "member1")
+		require.Nil(err)
+
+		count, err := users.Count(ctx)
+		require.Nil(err)
+		require.Equal(1, count)
+
+		err = users.AddParty(ctx, other)
+		require.Nil(err)
+
+		invalid := req
+		invalid.Members = []schema.QueueUserRequest{req.Members[0], req.Members[0]}
+		_, err = users.ParseParty(&invalid)
+		require.Error(err)
+
+		invalid = req
+		invalid.Members = nil
+		_, err = users.ParseParty(&invalid)
+		require.Error(err)
+
+		invalid = req
+		invalid.Name = ""
+		_, err = users.ParseParty(&invalid)
+		require.Error(err)
+	})
+}
+
 func TestUserQueueGetBins(t *testing.T) {
 	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
 		require := require.New(t)
-		users := factory(cfg)
+		users := factory(t, cfg)
+		wantUsers := newWantUsers(now())
 
 		for _, user := range wantUsers {
 			err := users.Add(ctx, user)
@@ -219,7 +383,485 @@ func TestUserQueueGetBins(t *testing.T) {
 	})
 }
 
-type factoryUserQueue func(cfg model.GridConfig) model.UserQueue
+func TestUserQueueReconfigure(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		require := require.New(t)
+		users := factory(t, cfg)
+
+		for _, user := range wantUsers[:5] {
+			require.Nil(users.Add(ctx, user))
+		}
+		party := []*model.QueuedUser{
+			{Name: "member0", Skill: 1, Latency: 1, QueuedAt: now(), Party: "party0"},
+			{Name: "member1", Skill: 9, Latency: 1, QueuedAt: now(), Party: "party0"},
+		}
+		require.Nil(users.AddParty(ctx, party))
+
+		finer := model.GridConfig{
+			SkillCeil:   10,
+			LatencyCeil: 10,
+			Side:        4,
+		}
+		require.Nil(users.Reconfigure(ctx, finer))
+
+		count, err := users.Count(ctx)
+		require.Nil(err)
+		require.Equal(7, count)
+
+		// the bin 00 is split, the QueuedAt is kept
+		bin, err := users.GetBin(ctx, model.BinIdx{1, 1})
+		require.Nil(err)
+		require.Len(bin, 1)
+		require.True(binContains(bin, wantUsers[0]))
+		bin, err = users.GetBin(ctx, model.BinIdx{0, 0})
+		require.Nil(err)
+		require.Len(bin, 1)
+		require.True(binContains(bin, wantUsers[3]))
+
+		// the party is still together, by the mean skill and latency
+		bin, err = users.GetBin(ctx, model.BinIdx{2, 0})
+		require.Nil(err)
+		require.Len(bin, 2)
+		require.True(binContains(bin, party[0]))
+		require.True(binContains(bin, party[1]))
+
+		status, err := users.Status(ctx, wantUsers[4].Name, 1)
+		require.Nil(err)
+		require.Equal(model.BinIdx{3, 1}, status.Bin)
+
+		// the new users are placed into the new grid
+		require.Nil(users.Add(ctx, wantUsers[9]))
+		bin, err = users.GetBin(ctx, model.BinIdx{3, 3})
+		require.Nil(err)
+		require.Len(bin, 1)
+
+		// and the party can still leave as a whole
+		require.Nil(users.Delete(ctx, "member0"))
+		count, err = users.Count(ctx)
+		require.Nil(err)
+		require.Equal(6, count)
+	})
+}
+
+func TestUserQueueClaim(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		require := require.New(t)
+		users := factory(t, cfg)
+
+		for _, user := range wantUsers {
+			require.Nil(users.Add(ctx, user))
+		}
+
+		claimed, err := users.Claim(ctx, []string{wantUsers[0].Name, wantUsers[1].Name})
+		require.Nil(err)
+		require.True(claimed)
+		count, err := users.Count(ctx)
+		require.Nil(err)
+		require.Equal(len(wantUsers)-2, count)
+
+		// one of them is gone, the rest stay queued
+		claimed, err = users.Claim(ctx, []string{wantUsers[1].Name, wantUsers[2].Name})
+		require.Nil(err)
+		require.False(claimed)
+		_, err = users.Status(ctx, wantUsers[2].Name, 1)
+		require.Nil(err)
+
+		// the overlapping groups are claimed by a single one of the instances
+		groups := [][]string{}
+		for idx := 2; idx+2 <= len(wantUsers); idx++ {
+			groups = append(groups, []string{wantUsers[idx].Name, wantUsers[idx+1].Name})
+		}
+		var mutex sync.Mutex
+		taken := make(map[string]int)
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, group := range groups {
+					claimed, err := users.Claim(ctx, group)
+					if err != nil || !claimed {
+						continue
+					}
+					mutex.Lock()
+					for _, name := range group {
+						taken[name]++
+					}
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		for name, times := range taken {
+			require.Equal(1, times, name)
+		}
+		count, err = users.Count(ctx)
+		require.Nil(err)
+		require.Equal(len(wantUsers)-2-len(taken), count)
+	})
+}
+
+// run with -race, the users are added, read and taken out from many goroutines at once
+func TestUserQueueConcurrent(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		grid := model.GridConfig{
+			SkillCeil:   1000,
+			LatencyCeil: 1000,
+			Side:        8,
+		}
+		users := factory(t, grid)
+		workers, rounds := 16, 200
+		// every change of the others is a write to a db or to a log, that takes ~50s under -race,
+		// far fewer of them still race with each other
+		if !strings.HasSuffix(t.Name(), "/inmem") {
+			workers, rounds = 8, 40
+		}
+
+		// the names that were added, and the ones that were taken out
+		var mutex sync.Mutex
+		added := []string{}
+		gone := make(map[string]struct{})
+		// errors.Join is safe to report from the goroutines, require is not
+		var failure error
+		fail := func(err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			failure = errors.Join(failure, err)
+		}
+		track := func(set map[string]struct{}, list *[]string, names ...string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, name := range names {
+				if set != nil {
+					set[name] = struct{}{}
+				}
+				if list != nil {
+					*list = append(*list, name)
+				}
+			}
+		}
+
+		var wg sync.WaitGroup
+		for worker := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for round := range rounds {
+					name := fmt.Sprintf("user%d-%d", worker, round)
+					value := float64((worker*rounds + round) * 37 % 1000)
+					err := users.Add(ctx, &model.QueuedUser{Name: name, Skill: value, Latency: 1000 - value, QueuedAt: now()})
+					if err != nil {
+						fail(err)
+						continue
+					}
+					track(nil, &added, name)
+
+					if round%3 == 0 {
+						party := fmt.Sprintf("party%d-%d", worker, round)
+						members := []*model.QueuedUser{
+							{Name: party + "-a", Skill: value, Latency: value, QueuedAt: now(), Party: party},
+							{Name: party + "-b", Skill: 1000 - value, Latency: value, QueuedAt: now(), Party: party},
+						}
+						err := users.AddParty(ctx, members)
+						if err != nil {
+							fail(err)
+							continue
+						}
+						track(nil, &added, members[0].Name, members[1].Name)
+
+						// the whole party leaves, unless it has been matched already
+						if round%2 == 0 {
+							err := users.Delete(ctx, members[1].Name)
+							if err != nil && !errors.Is(err, model.ErrNotQueued) {
+								fail(err)
+							}
+							track(gone, nil, members[0].Name, members[1].Name)
+						}
+					}
+
+					if round%5 == 0 {
+						err := users.Delete(ctx, name)
+						if err != nil && !errors.Is(err, model.ErrNotQueued) {
+							fail(err)
+						}
+						track(gone, nil, name)
+					}
+
+					err = users.Heartbeat(ctx, fmt.Sprintf("user%d-%d", worker, round/3))
+					if err != nil && !errors.Is(err, model.ErrNotQueued) {
+						fail(err)
+					}
+					_, err = users.Status(ctx, fmt.Sprintf("user%d-%d", worker, round/2), 1)
+					if err != nil && !errors.Is(err, model.ErrNotQueued) {
+						fail(err)
+					}
+					_, err = users.GetBin(ctx, model.BinIdx{S: round % grid.Side, L: worker % grid.Side})
+					if err != nil {
+						fail(err)
+					}
+					_, err = users.Count(ctx)
+					if err != nil {
+						fail(err)
+					}
+				}
+			}()
+		}
+
+		done := make(chan struct{})
+		var background sync.WaitGroup
+		// the matching loop, takes out the users of a random corner
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			for tick := 0; ; tick++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				lo := model.BinIdx{S: tick % 4, L: tick % 3}
+				batch, err := users.GetRect(ctx, lo, model.BinIdx{S: lo.S + 2, L: lo.L + 2}, 0)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				names := []string{}
+				for _, user := range batch {
+					names = append(names, user.Name)
+				}
+				err = users.Remove(ctx, names)
+				if err != nil {
+					fail(err)
+				}
+				track(gone, nil, names...)
+			}
+		}()
+		// the reaper, takes out the users not seen for a while
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+				}
+
+				names, err := users.Expire(ctx, now().Add(-5*time.Millisecond))
+				if err != nil {
+					fail(err)
+				}
+				track(gone, nil, names...)
+			}
+		}()
+		// and the admin, changes the grid back and forth
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			for side := range 6 {
+				time.Sleep(time.Millisecond)
+				grid := grid
+				grid.Side = 4 + side%2*4
+				err := users.Reconfigure(ctx, grid)
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+
+		wg.Wait()
+		close(done)
+		background.Wait()
+
+		require := require.New(t)
+		require.Nil(failure)
+
+		queued := 0
+		for _, name := range added {
+			status, err := users.Status(ctx, name, 0)
+			if _, isGone := gone[name]; isGone {
+				require.ErrorIs(err, model.ErrNotQueued, name)
+				continue
+			}
+			require.Nil(err, name)
+			queued++
+
+			bin, err := users.GetBin(ctx, status.Bin)
+			require.Nil(err)
+			require.True(binContains(bin, &status.QueuedUser), name)
+		}
+
+		count, err := users.Count(ctx)
+		require.Nil(err)
+		require.Equal(queued, count)
+	})
+}
+
+func TestUserQueueGetGrid(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		require := require.New(t)
+		users := factory(t, cfg)
+		// the cutoffs are 50s from the waits, so the users are queued just now
+		wantUsers := newWantUsers(now())
+
+		grid, err := users.GetGrid(ctx, 0)
+		require.Nil(err)
+		require.Empty(grid)
+
+		for _, user := range wantUsers {
+			require.Nil(users.Add(ctx, user))
+		}
+
+		// the same as the bins one by one
+		grid, err = users.GetGrid(ctx, 0)
+		require.Nil(err)
+		require.Len(grid, 4)
+		for idx, users := range map[model.BinIdx][]*model.QueuedUser{
+			{0, 0}: wantUsers[0:4],
+			{1, 0}: wantUsers[4:7],
+			{0, 1}: wantUsers[7:9],
+			{1, 1}: wantUsers[9:],
+		} {
+			require.Len(grid[idx], len(users))
+			for _, user := range users {
+				require.True(binContains(grid[idx], user), user.Name)
+			}
+		}
+
+		grid, err = users.GetGrid(ctx, 350*time.Second)
+		require.Nil(err)
+		require.Len(grid, 4)
+		require.Len(grid[model.BinIdx{0, 0}], 1)
+		require.True(binContains(grid[model.BinIdx{0, 0}], wantUsers[3]))
+		require.Len(grid[model.BinIdx{1, 0}], 3)
+
+		grid, err = users.GetGrid(ctx, 850*time.Second)
+		require.Nil(err)
+		require.Len(grid, 2)
+		require.Len(grid[model.BinIdx{0, 1}], 1)
+		require.Len(grid[model.BinIdx{1, 1}], 1)
+	})
+}
+
+func TestUserQueueOccupied(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		require := require.New(t)
+		users := factory(t, cfg)
+
+		counts, err := users.Occupied(ctx)
+		require.Nil(err)
+		require.Empty(counts)
+
+		for _, user := range wantUsers {
+			require.Nil(users.Add(ctx, user))
+		}
+
+		counts, err = users.Occupied(ctx)
+		require.Nil(err)
+		require.Equal(map[model.BinIdx]int{
+			{0, 0}: 4,
+			{1, 0}: 3,
+			{0, 1}: 2,
+			{1, 1}: 1,
+		}, counts)
+
+		// an emptied bin is not occupied anymore
+		require.Nil(users.Remove(ctx, []string{wantUsers[7].Name, wantUsers[8].Name}))
+		require.Nil(users.Delete(ctx, wantUsers[0].Name))
+
+		counts, err = users.Occupied(ctx)
+		require.Nil(err)
+		require.Equal(map[model.BinIdx]int{
+			{0, 0}: 3,
+			{1, 0}: 3,
+			{1, 1}: 1,
+		}, counts)
+	})
+}
+
+func TestUserQueueExpire(t *testing.T) {
+	rangeUserQueue(t, func(t *testing.T, factory factoryUserQueue) {
+		require := require.New(t)
+		users := factory(t, cfg)
+		// the fixtures and the cutoffs are all relative to the same moment
+		at := now()
+		wantUsers := newWantUsers(at)
+
+		for _, user := range wantUsers {
+			require.Nil(users.Add(ctx, user))
+		}
+		// seen when queued, 1000s ago
+		for _, party := range []string{"party0", "party1"} {
+			require.Nil(users.AddParty(ctx, []*model.QueuedUser{
+				{Name: party + "-member0", Skill: 1, Latency: 1, QueuedAt: at.Add(-1000 * time.Second), Party: party},
+				{Name: party + "-member1", Skill: 1, Latency: 1, QueuedAt: at.Add(-1000 * time.Second), Party: party},
+			}))
+		}
+
+		// a single member keeps the whole party
+		require.Nil(users.Heartbeat(ctx, "party0-member1"))
+		require.Nil(users.Heartbeat(ctx, wantUsers[9].Name))
+		require.ErrorIs(users.Heartbeat(ctx, "user-missing"), model.ErrNotQueued)
+
+		// the other party expires together
+		expired, err := users.Expire(ctx, at.Add(-550*time.Second))
+		require.Nil(err)
+		require.ElementsMatch([]string{wantUsers[5].Name, wantUsers[6].Name, wantUsers[7].Name, wantUsers[8].Name, "party1-member0", "party1-member1"}, expired)
+
+		count, err := users.Count(ctx)
+		require.Nil(err)
+		require.Equal(len(wantUsers)+4-6, count)
+
+		expired, err = users.Expire(ctx, at.Add(-550*time.Second))
+		require.Nil(err)
+		require.Empty(expired)
+
+		require.Nil(users.Heartbeat(ctx, wantUsers[0].Name))
+		expired, err = users.Expire(ctx, at.Add(-time.Second))
+		require.Nil(err)
+		require.ElementsMatch([]string{wantUsers[1].Name, wantUsers[2].Name, wantUsers[3].Name, wantUsers[4].Name}, expired)
+
+		count, err = users.Count(ctx)
+		require.Nil(err)
+		require.Equal(4, count)
+	})
+}
+
+type factoryUserQueue func(t *testing.T, cfg model.GridConfig) model.UserQueue
+
+func TestUserQueueNamespaces(t *testing.T) {
+	// only the postgres queues share the storage, the inmemory ones are separate anyway
+	require := require.New(t)
+	db, err := pgxpool.New(ctx, dbUrl)
+	require.Nil(err)
+	defer db.Close()
+	db.Exec(ctx, `delete from UserQueue`)
+
+	ranked := model.NewUserQueuePostgres(cfg, db, "ranked")
+	casual := model.NewUserQueuePostgres(cfg, db, "casual")
+
+	// the same user may wait in both of the queues
+	require.Nil(ranked.Add(ctx, wantUsers[0]))
+	require.Nil(casual.Add(ctx, wantUsers[0]))
+	require.Nil(ranked.Add(ctx, wantUsers[1]))
+
+	count, err := casual.Count(ctx)
+	require.Nil(err)
+	require.Equal(1, count)
+
+	bin, err := casual.GetBin(ctx, model.BinIdx{0, 0})
+	require.Nil(err)
+	require.Len(bin, 1)
+
+	err = casual.Delete(ctx, wantUsers[1].Name)
+	require.ErrorIs(err, model.ErrNotQueued)
+
+	require.Nil(ranked.Remove(ctx, []string{wantUsers[0].Name}))
+	_, err = casual.Status(ctx, wantUsers[0].Name, 1)
+	require.Nil(err)
+}
 
 func rangeUserQueue(t *testing.T, run func(*testing.T, factoryUserQueue)) {
 	table := []struct {
@@ -227,16 +869,30 @@ func rangeUserQueue(t *testing.T, run func(*testing.T, factoryUserQueue)) {
 		factory factoryUserQueue
 	}{
 		{
-			"inmem", func(cfg model.GridConfig) model.UserQueue {
+			"inmem", func(_ *testing.T, cfg model.GridConfig) model.UserQueue {
 				return model.NewUserQueueInmemory(cfg)
 			},
 		},
 		{
-			"postgres", func(cfg model.GridConfig) model.UserQueue {
+			// compacted often, so the compactions race with the changes too
+			"durable", func(t *testing.T, cfg model.GridConfig) model.UserQueue {
+				users, err := model.NewUserQueueDurable(cfg, t.TempDir(), 3)
+				require.Nil(t, err)
+				return users
+			},
+		},
+		{
+			"postgres", func(_ *testing.T, cfg model.GridConfig) model.UserQueue {
 				db, _ := pgxpool.New(context.Background(), dbUrl)
 				db.Exec(context.Background(), `delete from UserQueue`)
 				// can't `defer db.Close()`
-				return model.NewUserQueuePostgres(cfg, db)
+				return model.NewUserQueuePostgres(cfg, db, model.DefaultQueue)
+			},
+		},
+		{
+			"sqlite", func(_ *testing.T, cfg model.GridConfig) model.UserQueue {
+				db, _ := model.OpenSqlite(":memory:")
+				return model.NewUserQueueSqlite(cfg, db, model.DefaultQueue)
 			},
 		},
 	}
@@ -250,6 +906,8 @@ func rangeUserQueue(t *testing.T, run func(*testing.T, factoryUserQueue)) {
 func binContains(bin []*model.QueuedUser, user *model.QueuedUser) bool {
 	return slices.ContainsFunc(bin, func(other *model.QueuedUser) bool {
 		return user.Name == other.Name &&
+			user.Party == other.Party &&
+			slices.Equal(user.Roles, other.Roles) &&
 			user.Skill == other.Skill &&
 			user.Latency == other.Latency &&
 			user.QueuedAt.Sub(other.QueuedAt).Abs() <= time.Second
@@ -0,0 +1,149 @@
+package notify
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+const (
+	Queued  = "queued"
+	Widened = "widened"
+	Matched = "matched"
+	Expired = "expired"
+	// the user has left the queue by themselves
+	Left = "left"
+)
+
+// a subscriber that's too slow to read its events will miss some
+const bufferSize = 8
+
+// IsFinal reports whether the user has left the queue after the event
+func IsFinal(event schema.UserEvent) bool {
+	return event.Event == Matched || event.Event == Expired || event.Event == Left
+}
+
+// Hub is an in-process pub/sub keyed by user names
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[string]map[chan schema.UserEvent]struct{}
+	timers map[string]*time.Timer
+	// to the other instances, nil if there are none
+	relay Relay
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs:   make(map[string]map[chan schema.UserEvent]struct{}),
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+// Subscribe returns the user's events and a func to unsubscribe
+func (h *Hub) Subscribe(name string) (<-chan schema.UserEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan schema.UserEvent, bufferSize)
+	if _, exists := h.subs[name]; !exists {
+		h.subs[name] = make(map[chan schema.UserEvent]struct{})
+	}
+	h.subs[name][ch] = struct{}{}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(h.subs[name], ch)
+		if len(h.subs[name]) == 0 {
+			delete(h.subs, name)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// SetRelay makes Broadcast reach the subscribers of the other instances
+func (h *Hub) SetRelay(relay Relay) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.relay = relay
+}
+
+// Broadcast publishes the event on every instance, it is published on this one only if the relay fails
+func (h *Hub) Broadcast(name string, event schema.UserEvent) {
+	h.mu.Lock()
+	relay := h.relay
+	h.mu.Unlock()
+
+	if relay == nil {
+		h.Publish(name, event)
+		return
+	}
+	err := relay.Send(context.TODO(), name, event)
+	if err != nil {
+		log.Println(err)
+		h.Publish(name, event)
+	}
+}
+
+// Publish only reaches the subscribers of this instance
+func (h *Hub) Publish(name string, event schema.UserEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if IsFinal(event) {
+		h.cancel(name)
+	}
+	h.publish(name, event)
+}
+
+// PublishAfter delays an event, replacing the user's previously delayed one. It is broadcast once due
+func (h *Hub) PublishAfter(name string, delay time.Duration, event schema.UserEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cancel(name)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		h.mu.Lock()
+		// the timer was cancelled, but has already fired
+		if h.timers[name] != timer {
+			h.mu.Unlock()
+			return
+		}
+		delete(h.timers, name)
+		h.mu.Unlock()
+
+		h.Broadcast(name, event)
+	})
+	h.timers[name] = timer
+}
+
+// Cancel drops the user's delayed event
+func (h *Hub) Cancel(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cancel(name)
+}
+
+func (h *Hub) cancel(name string) {
+	if timer, exists := h.timers[name]; exists {
+		timer.Stop()
+		delete(h.timers, name)
+	}
+}
+
+func (h *Hub) publish(name string, event schema.UserEvent) {
+	for ch := range h.subs[name] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
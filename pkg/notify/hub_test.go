@@ -0,0 +1,97 @@
+package notify_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/starnuik/golang_match/pkg/notify"
+	"github.com/starnuik/golang_match/pkg/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHub(t *testing.T) {
+	require := require.New(t)
+	hub := notify.NewHub()
+
+	bob, unsubscribe := hub.Subscribe("bob")
+	alice, _ := hub.Subscribe("alice")
+
+	hub.Publish("bob", schema.UserEvent{Event: notify.Queued})
+	require.Equal(notify.Queued, (<-bob).Event)
+	require.Len(alice, 0)
+
+	hub.PublishAfter("bob", 10*time.Millisecond, schema.UserEvent{Event: notify.Widened})
+	select {
+	case event := <-bob:
+		require.Equal(notify.Widened, event.Event)
+	case <-time.After(time.Second):
+		require.Fail("no widened event")
+	}
+
+	// a final event drops the delayed one
+	hub.PublishAfter("bob", 10*time.Millisecond, schema.UserEvent{Event: notify.Widened})
+	hub.Publish("bob", schema.UserEvent{Event: notify.Matched})
+	require.Equal(notify.Matched, (<-bob).Event)
+	time.Sleep(50 * time.Millisecond)
+	require.Len(bob, 0)
+
+	// so does leaving
+	hub.PublishAfter("bob", 10*time.Millisecond, schema.UserEvent{Event: notify.Widened})
+	hub.Publish("bob", schema.UserEvent{Event: notify.Left})
+	require.Equal(notify.Left, (<-bob).Event)
+	require.True(notify.IsFinal(schema.UserEvent{Event: notify.Left}))
+	time.Sleep(50 * time.Millisecond)
+	require.Len(bob, 0)
+
+	unsubscribe()
+	hub.Publish("bob", schema.UserEvent{Event: notify.Queued})
+	require.Len(bob, 0)
+}
+
+// delivers back to the hub, like a relay of a single instance
+type loopback struct {
+	hub *notify.Hub
+	err error
+}
+
+func (l *loopback) Send(_ context.Context, name string, event schema.UserEvent) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.hub.Publish(name, event)
+	return nil
+}
+
+func (l *loopback) Close() {}
+
+func TestHubBroadcast(t *testing.T) {
+	require := require.New(t)
+	hub := notify.NewHub()
+	bob, _ := hub.Subscribe("bob")
+
+	// published locally without a relay
+	hub.Broadcast("bob", schema.UserEvent{Event: notify.Queued})
+	require.Equal(notify.Queued, (<-bob).Event)
+
+	relay := &loopback{hub: hub}
+	hub.SetRelay(relay)
+	hub.Broadcast("bob", schema.UserEvent{Event: notify.Matched})
+	require.Equal(notify.Matched, (<-bob).Event)
+	require.Len(bob, 0)
+
+	// the delayed events go through the relay too
+	hub.PublishAfter("bob", 10*time.Millisecond, schema.UserEvent{Event: notify.Widened})
+	select {
+	case event := <-bob:
+		require.Equal(notify.Widened, event.Event)
+	case <-time.After(time.Second):
+		require.Fail("no widened event")
+	}
+
+	// and the local subscribers get them if it fails
+	relay.err = errors.New("broken")
+	hub.Broadcast("bob", schema.UserEvent{Event: notify.Expired})
+	require.Equal(notify.Expired, (<-bob).Event)
+}
@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+const (
+	relayChannel = "user_events"
+	// postgres refuses the longer payloads
+	relayPayloadLimit = 8000
+	// the pause before listening again, after the connection has broken
+	relayRetry = time.Second
+)
+
+// the payload of a notification
+type relayEvent struct {
+	Name  string
+	Event schema.UserEvent
+}
+
+// NewRelayPostgres sends the events with NOTIFY, and publishes the ones of every instance to the hub.
+// It listens on a connection of its own, the events sent while it reconnects are lost
+func NewRelayPostgres(db *pgxpool.Pool, hub *Hub) Relay {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &pgRelay{
+		db:     db,
+		hub:    hub,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go r.listen(ctx)
+	return r
+}
+
+type pgRelay struct {
+	db     *pgxpool.Pool
+	hub    *Hub
+	cancel context.CancelFunc
+	// closed once listen has returned
+	done chan struct{}
+}
+
+// Send drops the teams of a match that doesn't fit into a notification, the match is left with its serial,
+// so the client can still get it from the history
+func (r *pgRelay) Send(ctx context.Context, name string, event schema.UserEvent) error {
+	payload, err := json.Marshal(relayEvent{Name: name, Event: event})
+	if err != nil {
+		return err
+	}
+	if len(payload) >= relayPayloadLimit && event.Match != nil {
+		event.Match = &schema.MatchResponse{Serial: event.Match.Serial, Queue: event.Match.Queue}
+		payload, err = json.Marshal(relayEvent{Name: name, Event: event})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = r.db.Exec(ctx, `select pg_notify($1, $2)`, relayChannel, string(payload))
+	return err
+}
+
+func (r *pgRelay) Close() {
+	r.cancel()
+	<-r.done
+}
+
+func (r *pgRelay) listen(ctx context.Context) {
+	defer close(r.done)
+
+	for {
+		err := r.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println(err)
+
+		select {
+		case <-time.After(relayRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// session listens until the connection breaks, the connection is closed after it, so it is not reused while listening
+func (r *pgRelay) session(ctx context.Context) error {
+	pooled, err := r.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, `listen `+relayChannel)
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var payload relayEvent
+		err = json.Unmarshal([]byte(notification.Payload), &payload)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		r.hub.Publish(payload.Name, payload.Event)
+	}
+}
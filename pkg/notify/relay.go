@@ -0,0 +1,15 @@
+package notify
+
+import (
+	"context"
+
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+// Relay carries the events between the hubs of the instances, so a user gets them from whichever one they are
+// subscribed to. An event sent comes back to the hub of the sender as well
+type Relay interface {
+	Send(ctx context.Context, name string, event schema.UserEvent) error
+	// Close stops the delivery to the hub
+	Close()
+}
@@ -1,9 +1,20 @@
 package schema
 
+import "time"
+
 type QueueUserRequest struct {
 	Name    string
 	Skill   float64
 	Latency float64
+	// the roles the user is willing to play, by preference, any role if empty
+	Roles []string
+	// region -> latency, for the queues with regions. Latency may be omitted then, it's the lowest of these
+	Latencies map[string]float64
+}
+
+type QueuePartyRequest struct {
+	Name    string
+	Members []QueueUserRequest
 }
 
 type Candle struct {
@@ -13,10 +24,68 @@ type Candle struct {
 	Deviation float64
 }
 
+type Team struct {
+	Names   []string
+	Skill   Candle
+	Latency Candle
+}
+
 type MatchResponse struct {
 	Serial      int
+	Queue       string
+	FormedAt    time.Time
 	Skill       Candle
 	Latency     Candle
 	WaitSeconds Candle
 	Names       []string
+	// only if the matches are split into teams
+	Teams []Team
+	// the difference between the highest and the lowest average team skill
+	SkillDelta float64
+	// the assigned role of every user, only if the matches have role slots
+	Roles map[string]string
+	// only for the queues with regions, the Latency candle is of the latencies to it
+	Region string
+	// the score of the group by the queue's scorer, in [0, 1]
+	Quality float64
+}
+
+type MatchListResponse struct {
+	Matches []MatchResponse
+	// pass as "since" to get the next page
+	Next int
+}
+
+type UserStatusResponse struct {
+	Name           string
+	Skill          float64
+	Latency        float64
+	QueuedAt       time.Time
+	WaitSeconds    float64
+	BinS           int
+	BinL           int
+	Position       int
+	BinCount       int
+	NeighbourCount int
+	// -1 if there were no matches in the users bin recently
+	EstimatedSeconds float64
+}
+
+type UserEvent struct {
+	Event string
+	// only for the "matched" event
+	Match *MatchResponse
+}
+
+// a message of the websocket session, in both directions
+//
+// client: "queue" (with User, and the Queue if not the default one), "cancel"
+//
+// server: "ack", "cancelled", "error" (with Error), and the UserEvent-s
+type SessionMessage struct {
+	Type  string
+	Queue string
+	User  *QueueUserRequest
+	Match *MatchResponse
+	Error string
 }
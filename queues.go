@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/starnuik/golang_match/pkg/matching"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/notify"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+var queueName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// a named queue (a game mode), with its own grid, kernel and tick rate
+type queue struct {
+	name string
+	// of the startup, from the env and QUEUES_FILE
+	settings settings
+	// the grid settings changed at runtime, on top of the ones of the startup. Saved in the settings store
+	reconfigured settings
+	users        model.UserQueue
+	kernel       matching.Kernel
+	kernelCfg    matching.KernelConfig
+	throughput   *matching.Throughput
+	tickRate     time.Duration
+	// the users not seen for longer are taken out, never if 0
+	ttl time.Duration
+	// held during a tick, so the grid is not reconfigured under the kernel
+	matching sync.Mutex
+}
+
+// findQueue replies with 404 if there is no such queue, the routes without a queue use the default one
+func findQueue(ctx *gin.Context) (*queue, bool) {
+	name := ctx.Param("queue")
+	if name == "" {
+		name = model.DefaultQueue
+	}
+
+	q, exists := queues[name]
+	if !exists {
+		errStatus(ctx, http.StatusNotFound, fmt.Errorf("unknown queue %s", name))
+		return nil, false
+	}
+	return q, true
+}
+
+// key scopes the events of a user to the queue, a user may wait in several queues at once
+func (q *queue) key(name string) string {
+	return q.name + "/" + name
+}
+
+func (q *queue) publishQueued(name string) {
+	hub.Publish(q.key(name), schema.UserEvent{Event: notify.Queued})
+	if q.kernelCfg.WaitSoftLimit > 0 {
+		hub.PublishAfter(q.key(name), q.kernelCfg.WaitSoftLimit, schema.UserEvent{Event: notify.Widened})
+	}
+}
+
+// settings of a queue, keyed by the names of the env variables.
+// The missing ones are taken from the env, so the queues can share them
+type settings map[string]string
+
+func (s settings) lookup(key string) (string, bool) {
+	if value, exists := s[key]; exists {
+		return value, true
+	}
+	return os.LookupEnv(key)
+}
+
+func (s settings) get(key string) string {
+	value, _ := s.lookup(key)
+	return value
+}
+
+func (s settings) atoi(key string) (int, error) {
+	out, err := strconv.Atoi(s.get(key))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return out, nil
+}
+
+// same as atoi, but for optional settings
+func (s settings) atoiOr(key string, fallback int) (int, error) {
+	if _, exists := s.lookup(key); !exists {
+		return fallback, nil
+	}
+	return s.atoi(key)
+}
+
+// same as atoiOr, but for floats
+func (s settings) atofOr(key string, fallback float64) (float64, error) {
+	if _, exists := s.lookup(key); !exists {
+		return fallback, nil
+	}
+	out, err := strconv.ParseFloat(s.get(key), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return out, nil
+}
+
+// loadSettings reads QUEUES_FILE, a json object of queue name -> settings (strings or numbers).
+// Without the file there is a single default queue, configured by the env
+func loadSettings() map[string]settings {
+	path, exists := os.LookupEnv("QUEUES_FILE")
+	if !exists {
+		return map[string]settings{model.DefaultQueue: {}}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer file.Close()
+
+	var raw map[string]map[string]any
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	err = decoder.Decode(&raw)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(raw) == 0 {
+		log.Panicln("QUEUES_FILE has no queues")
+	}
+
+	all := make(map[string]settings, len(raw))
+	for name, values := range raw {
+		if !queueName.MatchString(name) {
+			log.Panicf("queue name %q is invalid\n", name)
+		}
+
+		s := make(settings, len(values))
+		for key, value := range values {
+			s[key] = fmt.Sprint(value)
+		}
+		all[name] = s
+	}
+	return all
+}
+
+func setupQueue(name string, s settings, newQueue func(model.GridConfig, string) model.UserQueue) *queue {
+	log.Printf("setting up the %s queue\n", name)
+
+	tickMs, err := s.atoi("TICK_MS")
+	if err != nil {
+		log.Panicln(err)
+	}
+	if tickMs <= 0 {
+		log.Panicln("TICK_MS must be > 0")
+	}
+	throughputWindowMs, err := s.atoiOr("TUNING_THROUGHPUT_WINDOW_MS", 300_000)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if throughputWindowMs <= 0 {
+		log.Panicln("TUNING_THROUGHPUT_WINDOW_MS must be > 0")
+	}
+
+	// optional, the heartbeats are only required with it
+	ttlMs, err := s.atoiOr("USER_TTL_MS", 0)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if ttlMs < 0 {
+		log.Panicln("USER_TTL_MS must be >= 0")
+	}
+
+	// the grid may have been reconfigured before the restart, or by another instance
+	reconfigured, err := settingsStore.Load(context.TODO(), name)
+	if err != nil {
+		log.Panicln(err)
+	}
+	grid, kernel, kernelCfg, err := setupGridMatching(withChanges(s, reconfigured))
+	if err != nil {
+		log.Panicln(err)
+	}
+	users := newQueue(grid, name)
+
+	// optional, "region,region..."
+	if regionList := s.get("REGIONS"); regionList != "" {
+		regions := []string{}
+		for _, region := range strings.Split(regionList, ",") {
+			region = strings.TrimSpace(region)
+			if !queueName.MatchString(region) {
+				log.Panicf("region name %q is invalid\n", region)
+			}
+			regions = append(regions, region)
+		}
+
+		// every region gets its own copy of the grid, the learning axes only see the latencies to their region
+		users = model.NewUserQueueRegional(grid, users, regions, func(grid model.GridConfig, region string) model.UserQueue {
+			return newQueue(grid, name+"@"+region)
+		})
+		kernel = matching.NewRegionKernel(kernel)
+	}
+
+	return &queue{
+		name:         name,
+		settings:     s,
+		reconfigured: reconfigured,
+		users:        users,
+		kernel:       kernel,
+		kernelCfg:    kernelCfg,
+		throughput:   matching.NewThroughput(grid, time.Duration(throughputWindowMs)*time.Millisecond),
+		tickRate:     time.Duration(tickMs) * time.Millisecond,
+		ttl:          time.Duration(ttlMs) * time.Millisecond,
+	}
+}
+
+// setupGridMatching checks the settings that can be reconfigured, the same way on the startup and at runtime
+func setupGridMatching(s settings) (model.GridConfig, matching.Kernel, matching.KernelConfig, error) {
+	gridSide, err := s.atoi("TUNING_GRID_SIDE")
+	if err != nil {
+		return model.GridConfig{}, nil, matching.KernelConfig{}, err
+	}
+	if gridSide <= 0 {
+		return model.GridConfig{}, nil, matching.KernelConfig{}, errors.New("TUNING_GRID_SIDE must be > 0")
+	}
+
+	grid, err := setupGrid(s, gridSide)
+	if err != nil {
+		return model.GridConfig{}, nil, matching.KernelConfig{}, err
+	}
+	kernel, kernelCfg, err := setupMatching(s, gridSide)
+	if err != nil {
+		return model.GridConfig{}, nil, matching.KernelConfig{}, err
+	}
+	return grid, kernel, kernelCfg, nil
+}
+
+// withChanges returns the settings, overridden by the changed ones
+func withChanges(s settings, changed map[string]string) settings {
+	out := make(settings, len(s)+len(changed))
+	maps.Copy(out, s)
+	maps.Copy(out, changed)
+	return out
+}
+
+// the settings that can be changed without a restart
+var gridSettings = []string{
+	"TUNING_GRID_SIDE",
+	"TUNING_SKILL_CEIL",
+	"TUNING_LATENCY_CEIL",
+	"TUNING_SKILL_AXIS",
+	"TUNING_LATENCY_AXIS",
+	"TUNING_PARTY_AGGREGATE",
+}
+
+var errInvalidSettings = errors.New("invalid settings")
+
+// reconfigure checks the changed settings, saves them for the restarts and the other instances, then applies them.
+// If the users fail to move, the next reload retries it
+func (q *queue) reconfigure(ctx context.Context, changed settings) error {
+	q.matching.Lock()
+	defer q.matching.Unlock()
+
+	reconfigured := withChanges(q.reconfigured, changed)
+	_, _, _, err := setupGridMatching(withChanges(q.settings, reconfigured))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidSettings, err)
+	}
+
+	err = settingsStore.Save(ctx, q.name, reconfigured)
+	if err != nil {
+		return err
+	}
+	return q.apply(ctx, reconfigured)
+}
+
+// reload applies the settings saved by another instance, or by a reconfigure that has failed halfway
+func (q *queue) reload(ctx context.Context) error {
+	saved, err := settingsStore.Load(ctx, q.name)
+	if err != nil {
+		return err
+	}
+
+	q.matching.Lock()
+	defer q.matching.Unlock()
+
+	if maps.Equal(saved, q.reconfigured) {
+		return nil
+	}
+	return q.apply(ctx, saved)
+}
+
+// apply moves the queued users into the grid of the reconfigured settings, the matching lock must be held
+func (q *queue) apply(ctx context.Context, reconfigured settings) error {
+	grid, kernel, kernelCfg, err := setupGridMatching(withChanges(q.settings, reconfigured))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidSettings, err)
+	}
+	if _, regional := q.users.(model.RegionalQueue); regional {
+		kernel = matching.NewRegionKernel(kernel)
+	}
+
+	err = q.users.Reconfigure(ctx, grid)
+	if err != nil {
+		return err
+	}
+
+	q.reconfigured = reconfigured
+	q.kernel = kernel
+	// the rest of the kernel config is unchanged, and is read by the handlers
+	q.kernelCfg.GridSide = kernelCfg.GridSide
+	q.throughput.Reconfigure(grid)
+	log.Printf("%s: reconfigured the grid, %v\n", q.name, reconfigured)
+	return nil
+}
+
+// reconfigureGrid takes a json object of the grid settings to change, keyed by the names of the env variables
+func reconfigureGrid(ctx *gin.Context) {
+	q, found := findQueue(ctx)
+	if !found {
+		return
+	}
+
+	var raw map[string]any
+	decoder := json.NewDecoder(ctx.Request.Body)
+	decoder.UseNumber()
+	err := decoder.Decode(&raw)
+	if err != nil {
+		errStatus(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	changed := make(settings, len(raw))
+	for key, value := range raw {
+		if !slices.Contains(gridSettings, key) {
+			errStatus(ctx, http.StatusBadRequest, fmt.Errorf("%s can't be changed without a restart", key))
+			return
+		}
+		changed[key] = fmt.Sprint(value)
+	}
+
+	err = q.reconfigure(context.TODO(), changed)
+	if errors.Is(err, errInvalidSettings) {
+		errStatus(ctx, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		errStatus(ctx, http.StatusInternalServerError, err)
+		return
+	}
+}
@@ -0,0 +1 @@
+curl -X DELETE localhost:8080/api/users/$1
\ No newline at end of file
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/starnuik/golang_match/pkg/model"
+	"github.com/starnuik/golang_match/pkg/notify"
+	"github.com/starnuik/golang_match/pkg/schema"
+)
+
+const (
+	sessionQueue     = "queue"
+	sessionCancel    = "cancel"
+	sessionAck       = "ack"
+	sessionCancelled = "cancelled"
+	sessionError     = "error"
+)
+
+var upgrader = websocket.Upgrader{
+	// the service has no cookies or sessions to protect
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// a single user's matchmaking over one websocket connection
+type session struct {
+	conn *websocket.Conn
+	// empty if the user is not queued
+	name        string
+	q           *queue
+	events      <-chan schema.UserEvent
+	unsubscribe func()
+	// keeps the user from expiring while the connection is open, nil without a ttl
+	heartbeat *time.Ticker
+}
+
+func userSession(ctx *gin.Context) {
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// the upgrader has already replied
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	s := session{conn: conn}
+	defer s.leave()
+
+	// the reader stops once the session is done, its pending read fails as the connection is closed
+	incoming := make(chan schema.SessionMessage)
+	closed := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			var msg schema.SessionMessage
+			err := conn.ReadJSON(&msg)
+			if err != nil {
+				closed <- err
+				return
+			}
+			select {
+			case incoming <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-incoming:
+			err = s.handle(msg)
+		case event := <-s.events:
+			err = s.forward(event)
+		case <-s.heartbeats():
+			s.refresh()
+		case err = <-closed:
+		}
+
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
+
+func (s *session) handle(msg schema.SessionMessage) error {
+	switch msg.Type {
+	case sessionQueue:
+		if s.name != "" {
+			return s.fail(fmt.Errorf("already queued as %s", s.name))
+		}
+		if msg.User == nil {
+			return s.fail(fmt.Errorf("no user"))
+		}
+		if msg.Queue == "" {
+			msg.Queue = model.DefaultQueue
+		}
+		q, exists := queues[msg.Queue]
+		if !exists {
+			return s.fail(fmt.Errorf("unknown queue %s", msg.Queue))
+		}
+
+		user, err := q.users.Parse(msg.User)
+		if err != nil {
+			return s.fail(err)
+		}
+		err = q.kernelCfg.CheckRoles([]*model.QueuedUser{user})
+		if err != nil {
+			return s.fail(err)
+		}
+
+		events, unsubscribe := hub.Subscribe(q.key(user.Name))
+		err = q.users.Add(context.TODO(), user)
+		if err != nil {
+			unsubscribe()
+			return s.fail(err)
+		}
+
+		s.name, s.q, s.events, s.unsubscribe = user.Name, q, events, unsubscribe
+		if q.ttl > 0 {
+			s.heartbeat = time.NewTicker(q.ttl / 3)
+		}
+		err = s.send(schema.SessionMessage{Type: sessionAck})
+		q.publishQueued(user.Name)
+		return err
+	case sessionCancel:
+		if s.name == "" {
+			return s.fail(model.ErrNotQueued)
+		}
+
+		err := s.leave()
+		if err != nil {
+			return s.fail(err)
+		}
+		return s.send(schema.SessionMessage{Type: sessionCancelled})
+	default:
+		return s.fail(fmt.Errorf("unknown message type %q", msg.Type))
+	}
+}
+
+func (s *session) forward(event schema.UserEvent) error {
+	if notify.IsFinal(event) {
+		s.reset()
+	}
+	return s.send(schema.SessionMessage{Type: event.Event, Match: event.Match})
+}
+
+// leave dequeues the session's user, if there is one
+func (s *session) leave() error {
+	if s.name == "" {
+		return nil
+	}
+
+	name, q := s.name, s.q
+	s.reset()
+
+	err := q.users.Delete(context.TODO(), name)
+	// the user got matched, but the event hasn't been read yet
+	if errors.Is(err, model.ErrNotQueued) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the session has unsubscribed already, this ends the event streams of the user elsewhere
+	hub.Broadcast(q.key(name), schema.UserEvent{Event: notify.Left})
+	return nil
+}
+
+// heartbeats never fire if the user is not queued, or the queue has no ttl
+func (s *session) heartbeats() <-chan time.Time {
+	if s.heartbeat == nil {
+		return nil
+	}
+	return s.heartbeat.C
+}
+
+func (s *session) refresh() {
+	err := s.q.users.Heartbeat(context.TODO(), s.name)
+	// the user got matched or expired, the event is on its way
+	if err != nil && !errors.Is(err, model.ErrNotQueued) {
+		log.Println(err)
+	}
+}
+
+func (s *session) reset() {
+	s.unsubscribe()
+	if s.heartbeat != nil {
+		s.heartbeat.Stop()
+		s.heartbeat = nil
+	}
+	s.name, s.q, s.events, s.unsubscribe = "", nil, nil, nil
+}
+
+func (s *session) send(msg schema.SessionMessage) error {
+	return s.conn.WriteJSON(msg)
+}
+
+// fail reports a client error, the session continues
+func (s *session) fail(err error) error {
+	return s.send(schema.SessionMessage{Type: sessionError, Error: err.Error()})
+}